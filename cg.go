@@ -1,6 +1,10 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"math"
+	"strings"
+)
 
 func write(s string) {
 	OutFile.WriteString(s)
@@ -17,6 +21,14 @@ var reglist = [4]string{"%r8", "%r9", "%r10", "%r11"}
 var breglist = [4]string{"%r8b", "%r9b", "%r10b", "%r11b"}
 var dreglist = [4]string{"%r8d", "%r9d", "%r10d", "%r11d"}
 
+// The registers used to pass the first
+// six arguments to a function, in order
+const MaxRegisterArgs = 6
+
+var paramreglist = [MaxRegisterArgs]string{"%rdi", "%rsi", "%rdx", "%rcx", "%r8", "%r9"}
+var parambreglist = [MaxRegisterArgs]string{"%dil", "%sil", "%dl", "%cl", "%r8b", "%r9b"}
+var paramdreglist = [MaxRegisterArgs]string{"%edi", "%esi", "%edx", "%ecx", "%r8d", "%r9d"}
+
 // Set all registers as available
 func freeall_registers() {
 	for i := range freereg {
@@ -106,13 +118,65 @@ func cgmul(r1, r2 int) int {
 	return r2
 }
 
-// Divide the first register by the second and
-// return the number of the register with the result
-func cgdiv(r1, r2 int) int {
+// Divide the first register by the second, and return the
+// number of the register with the quotient, or with the
+// remainder for OpModulo. Unsigned types use an unsigned divide
+func cgdivmod(op OpType, r1, r2 int, t *Type) int {
 	writef("\tmovq\t%s,%%rax\n", reglist[r1])
-	write("\tcqo\n")
-	writef("\tidivq\t%s\n", reglist[r2])
-	writef("\tmovq\t%%rax,%s\n", reglist[r1])
+	if t.isUnsigned() {
+		write("\txorq\t%rdx,%rdx\n")
+		writef("\tdivq\t%s\n", reglist[r2])
+	} else {
+		write("\tcqo\n")
+		writef("\tidivq\t%s\n", reglist[r2])
+	}
+	if op == OpModulo {
+		writef("\tmovq\t%%rdx,%s\n", reglist[r1])
+	} else {
+		writef("\tmovq\t%%rax,%s\n", reglist[r1])
+	}
+	free_register(r2)
+	return r1
+}
+
+// Bitwise AND two registers together and return
+// the number of the register with the result
+func cgand(r1, r2 int) int {
+	writef("\tandq\t%s, %s\n", reglist[r1], reglist[r2])
+	free_register(r1)
+	return r2
+}
+
+// Bitwise OR two registers together and return
+// the number of the register with the result
+func cgor(r1, r2 int) int {
+	writef("\torq\t%s, %s\n", reglist[r1], reglist[r2])
+	free_register(r1)
+	return r2
+}
+
+// Bitwise XOR two registers together and return
+// the number of the register with the result
+func cgxor(r1, r2 int) int {
+	writef("\txorq\t%s, %s\n", reglist[r1], reglist[r2])
+	free_register(r1)
+	return r2
+}
+
+// Shift the first register left by the second
+// and return the number of the register with the result
+func cgshl(r1, r2 int) int {
+	writef("\tmovb\t%s, %%cl\n", breglist[r2])
+	writef("\tsalq\t%%cl, %s\n", reglist[r1])
+	free_register(r2)
+	return r1
+}
+
+// Shift the first register right by the second
+// and return the number of the register with the result
+func cgshr(r1, r2 int) int {
+	writef("\tmovb\t%s, %%cl\n", breglist[r2])
+	writef("\tsarq\t%%cl, %s\n", reglist[r1])
 	free_register(r2)
 	return r1
 }
@@ -129,12 +193,12 @@ func cgprintint(r int) {
 func cgloadglob(sym *Symbol) int {
 	// Get a new register
 	r := alloc_register()
-	switch sym.t {
-	case NodeChar:
+	switch cgprimsize(sym.t) {
+	case 1:
 		writef("\tmovzbq\t%s(%%rip), %s\n", sym.name, reglist[r])
-	case NodeInt:
-		writef("\tmovzbl\t%s(%%rip), %s\n", sym.name, reglist[r])
-	case NodeLong, NodeCharPointer, NodeIntPointer, NodeLongPointer:
+	case 4:
+		writef("\tmovslq\t%s(%%rip), %s\n", sym.name, reglist[r])
+	case 8:
 		writef("\tmovq\t%s(%%rip), %s\n", sym.name, reglist[r])
 	default:
 		fatal("bad type in cgloadglob %v\n", sym.t)
@@ -144,29 +208,108 @@ func cgloadglob(sym *Symbol) int {
 
 // Store a register's value into a variable
 func cgstorglob(r int, sym *Symbol) int {
-	switch sym.t {
-	case NodeChar:
+	switch cgprimsize(sym.t) {
+	case 1:
 		writef("\tmovb\t%s, %s(%%rip)\n", breglist[r], sym.name)
-	case NodeInt:
+	case 4:
 		writef("\tmovl\t%s, %s(%%rip)\n", dreglist[r], sym.name)
-	case NodeLong, NodeCharPointer, NodeIntPointer, NodeLongPointer:
+	case 8:
 		writef("\tmovq\t%s, %s(%%rip)\n", reglist[r], sym.name)
 	default:
-		fatal("bad type in cgloadglob %v\n", sym.t)
+		fatal("bad type in cgstorglob %v\n", sym.t)
+	}
+	return r
+}
+
+// Load a value from a local variable into a register.
+// Return the number of the register
+func cgloadlocal(sym *Symbol) int {
+	// Get a new register
+	r := alloc_register()
+	switch cgprimsize(sym.t) {
+	case 1:
+		writef("\tmovzbq\t%d(%%rbp), %s\n", sym.posn, reglist[r])
+	case 4:
+		writef("\tmovslq\t%d(%%rbp), %s\n", sym.posn, reglist[r])
+	case 8:
+		writef("\tmovq\t%d(%%rbp), %s\n", sym.posn, reglist[r])
+	default:
+		fatal("bad type in cgloadlocal %v\n", sym.t)
+	}
+	return r
+}
+
+// Store a register's value into a local variable
+func cgstorlocal(r int, sym *Symbol) int {
+	switch cgprimsize(sym.t) {
+	case 1:
+		writef("\tmovb\t%s, %d(%%rbp)\n", breglist[r], sym.posn)
+	case 4:
+		writef("\tmovl\t%s, %d(%%rbp)\n", dreglist[r], sym.posn)
+	case 8:
+		writef("\tmovq\t%s, %d(%%rbp)\n", reglist[r], sym.posn)
+	default:
+		fatal("bad type in cgstorlocal %v\n", sym.t)
 	}
 	return r
 }
 
 // Generate a global symbol
-func cgglobsym(sym *Symbol) {
-	typeSize := cgprimsize(sym.t)
-	writef("\t.comm\t%s,%d,%d\n", sym.name, typeSize, typeSize)
+func cgglobsym(sym *Symbol, init *ASTNode) {
+	if init == nil {
+		writef("\t.comm\t%s,%d,%d\n", sym.name, cgprimsize(sym.t), cgalign(sym.t))
+		return
+	}
+	// An initialised variable goes in the data section
+	writef("\t.data\n\t.globl\t%s\n\t.align\t%d\n%s:\n", sym.name, cgalign(sym.t), sym.name)
+	value := fmt.Sprintf("%d", init.value)
+	if init.op == OpStringLiteral {
+		value = fmt.Sprintf("L%d", init.value)
+	}
+	switch cgprimsize(sym.t) {
+	case 1:
+		writef("\t.byte\t%s\n", value)
+	case 4:
+		writef("\t.long\t%s\n", value)
+	case 8:
+		writef("\t.quad\t%s\n", value)
+	default:
+		fatal("bad type in cgglobsym %v\n", sym.t)
+	}
+	write("\t.text\n")
+}
+
+// Switch to the read-only data section
+func cgrodata() {
+	write("\t.section\t.rodata\n")
+}
+
+// Generate a string literal with the given label.
+// Bytes which aren't printable are written in octal
+func cgglobstr(l int, s string) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < ' ' || c > '~' || c == '"' || c == '\\' {
+			fmt.Fprintf(&b, "\\%03o", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	writef("L%d:\n\t.string\t\"%s\"\n", l, b.String())
+}
+
+// Load the address of a string literal into a new register
+func cgloadglobstr(l int) int {
+	r := alloc_register()
+	writef("\tleaq\tL%d(%%rip), %s\n", l, reglist[r])
+	return r
 }
 
 // Widen the value in the register from the old
 // to the new type, and return a register with
 // this new value
-func cgwiden(reg int, oldtype, newtype NodeType) int {
+func cgwiden(reg int, oldtype, newtype *Type) int {
 	// Nothing to do
 	return reg
 }
@@ -216,10 +359,76 @@ func cgcompare_and_jump(ASTop OpType, r1, r2, label int) int {
 	}
 	writef("\tcmpq\t%s, %s\n", reglist[r2], reglist[r1])
 	writef("\t%s\tL%d\n", op, label)
-	freeall_registers()
+	free_register(r1)
+	free_register(r2)
 	return NoReg
 }
 
+// Test a register against zero and jump to the label
+// if it is non-zero, or if ifTrue is false, if it is zero
+func cgtest_and_jump(r int, ifTrue bool, label int) {
+	op := "je"
+	if ifTrue {
+		op = "jne"
+	}
+	writef("\ttestq\t%s, %s\n", reglist[r], reglist[r])
+	writef("\t%s\tL%d\n", op, label)
+	free_register(r)
+}
+
+// Set a new register to the value of a logical expression
+// whose outcome has been decided: !value when carrying
+// on from the code before, or value after a jump to the
+// label. Return the register
+func cgshortcircuit(value bool, label, endLabel int) int {
+	r := alloc_register()
+	v := 0
+	if value {
+		v = 1
+	}
+	writef("\tmovq\t$%d, %s\n", 1-v, reglist[r])
+	cgjump(endLabel)
+	cglabel(label)
+	writef("\tmovq\t$%d, %s\n", v, reglist[r])
+	cglabel(endLabel)
+	return r
+}
+
+// Jump to the label if the register holds the value
+func cgcase_and_jump(r, value, label int) {
+	if value >= math.MinInt32 && value <= math.MaxInt32 {
+		writef("\tcmpq\t$%d, %s\n", value, reglist[r])
+	} else {
+		writef("\tmovq\t$%d, %%rdx\n", value)
+		writef("\tcmpq\t%%rdx, %s\n", reglist[r])
+	}
+	writef("\tje\tL%d\n", label)
+}
+
+// Jump to the label in the table at the position of the
+// register's value minus the lowest value, or to the default
+// label if it is outside the table. The table holds the offset
+// of each label from the table, so it can be read-only
+func cgjumptable(r, low int, labels []int, table, defaultLabel int) {
+	if low != 0 {
+		writef("\tsubq\t$%d, %s\n", low, reglist[r])
+	}
+	// Values below the lowest wrap around to large unsigned ones
+	writef("\tcmpq\t$%d, %s\n", len(labels)-1, reglist[r])
+	writef("\tja\tL%d\n", defaultLabel)
+	writef("\tleaq\tL%d(%%rip), %%rax\n", table)
+	writef("\tmovslq\t(%%rax,%s,4), %%rdx\n", reglist[r])
+	write("\taddq\t%rdx, %rax\n")
+	write("\tjmp\t*%rax\n")
+	cgrodata()
+	writef("\t.align\t4\nL%d:\n", table)
+	for _, l := range labels {
+		writef("\t.long\tL%d-L%d\n", l, table)
+	}
+	write("\t.text\n")
+	free_register(r)
+}
+
 // Generate a label
 func cglabel(l int) {
 	writef("L%d:\n", l)
@@ -230,94 +439,388 @@ func cgjump(l int) {
 	writef("\tjmp\tL%d\n", l)
 }
 
+// Position of the next local variable relative to the stack
+// base pointer, and the size of the current function's frame
+var localOffset, stackOffset int
+
+// Reset the position of new local variables when parsing a new function
+func cgresetlocals() {
+	localOffset = 0
+}
+
+// Get the position of the next local variable. The slot
+// is aligned for its type, and the offset returned is
+// negative as the stack grows downwards
+func cggetlocaloffset(sym *Symbol) int {
+	align := cgalign(sym.t)
+	localOffset += cgprimsize(sym.t)
+	localOffset = (localOffset + align - 1) &^ (align - 1)
+	return -localOffset
+}
+
 // Print out a function preamble
-func cgfuncpreamble(name string) {
+func cgfuncpreamble(sym *Symbol) {
+	name := sym.name
+	// Parameters passed in registers get a slot in the stack frame.
+	// The rest were pushed by the caller and sit above the return
+	// address and the saved base pointer
+	cgresetlocals()
+	for i, param := range sym.params {
+		if i < MaxRegisterArgs {
+			param.posn = cggetlocaloffset(param)
+		} else {
+			param.posn = 16 + 8*(i-MaxRegisterArgs)
+		}
+	}
+	// Give each local a slot in the stack frame
+	for _, local := range sym.locals {
+		local.posn = cggetlocaloffset(local)
+	}
+	// Align the stack pointer to be a multiple of 16
+	stackOffset = (localOffset + 15) &^ 15
+	pushDepth = 0
+
 	write("\t.text\n")
 	writef("\t.globl\t%s\n", name)
 	writef("\t.type\t%s, @function\n", name)
 	writef("%s:\n", name)
 	write("\tpushq\t%rbp\n")
 	write("\tmovq\t%rsp, %rbp\n")
+	if stackOffset != 0 {
+		writef("\tsubq\t$%d, %%rsp\n", stackOffset)
+	}
+	// Copy the register parameters into their slots
+	for i, param := range sym.params {
+		if i == MaxRegisterArgs {
+			break
+		}
+		switch cgprimsize(param.t) {
+		case 1:
+			writef("\tmovb\t%s, %d(%%rbp)\n", parambreglist[i], param.posn)
+		case 4:
+			writef("\tmovl\t%s, %d(%%rbp)\n", paramdreglist[i], param.posn)
+		case 8:
+			writef("\tmovq\t%s, %d(%%rbp)\n", paramreglist[i], param.posn)
+		default:
+			fatal("bad parameter type in cgfuncpreamble %v\n", param.t)
+		}
+	}
 }
 
 // Print out a function postamble
 func cgfuncpostamble(sym *Symbol) {
 	cglabel(sym.endLabel)
+	if stackOffset != 0 {
+		writef("\taddq\t$%d, %%rsp\n", stackOffset)
+	}
 	write("\tpopq %rbp\n\tret\n")
 }
 
-// Array of type sizes in P_XXX order.
-// 0 means no size. P_NONE, P_VOID, P_CHAR, P_INT, P_LONG
-var typeSizes = map[NodeType]int{
-	NodeNone:        0,
-	NodeVoid:        0,
-	NodeChar:        1,
-	NodeInt:         4,
-	NodeLong:        8,
-	NodeVoidPointer: 8,
-	NodeCharPointer: 8,
-	NodeIntPointer:  8,
-	NodeLongPointer: 8,
-}
-
-// Given a P_XXX type value, return the
-// size of a primitive type in bytes.
-func cgprimsize(t NodeType) int {
-	// Check the type is valid
-	size, ok := typeSizes[t]
-	if !ok {
-		fatal("Bad type in cgprimsize() %v\n", t)
+// Given a type, return its size in bytes.
+// Zero means that the type has no size
+func cgprimsize(t *Type) int {
+	switch t.kind {
+	case KindChar:
+		return 1
+	case KindInt:
+		return 4
+	case KindLong, KindPointer:
+		return 8
+	case KindArray:
+		if t.length < 0 {
+			return 0
+		}
+		return cgprimsize(t.base) * t.length
+	case KindStruct, KindUnion:
+		return t.composite.size
 	}
-	return size
+	return 0
 }
 
-// Call a function with one argument from the given register
-// Return the register with the result
-func cgcall(r int, sym *Symbol) int {
-	// Get a new register
-	outr := alloc_register()
-	writef("\tmovq\t%s, %%rdi\n", reglist[r])
-	writef("\tcall\t%s\n", sym.name)
-	writef("\tmovq\t%%rax, %s\n", reglist[outr])
+// Given a type, return its alignment in bytes
+func cgalign(t *Type) int {
+	switch t.kind {
+	case KindArray:
+		return cgalign(t.base)
+	case KindStruct, KindUnion:
+		return t.composite.align
+	}
+	if size := cgprimsize(t); size > 1 {
+		return size
+	}
+	return 1
+}
+
+// Number of 8-byte values pushed on the stack since the function
+// preamble, used to keep the stack aligned at each call
+var pushDepth int
+
+// Push the registers in use onto the stack and mark them as
+// free. Return the list of registers that were spilled
+func cgspillregs() []int {
+	spilled := []int{}
+	for i := range freereg {
+		if freereg[i] == 0 {
+			writef("\tpushq\t%s\n", reglist[i])
+			pushDepth++
+			freereg[i] = 1
+			spilled = append(spilled, i)
+		}
+	}
+	return spilled
+}
+
+// Pop the spilled registers back off the
+// stack and mark them as in use again
+func cgunspillregs(spilled []int) {
+	for i := len(spilled) - 1; i >= 0; i-- {
+		writef("\tpopq\t%s\n", reglist[spilled[i]])
+		pushDepth--
+		freereg[spilled[i]] = 0
+	}
+}
+
+// Push a register's value onto the stack and free the register
+func cgpush(r int) {
+	writef("\tpushq\t%s\n", reglist[r])
+	pushDepth++
 	free_register(r)
+}
+
+// Get ready to push the arguments for a call. The stack
+// must be 16-byte aligned once the arguments which don't
+// fit in registers are on it, so pad it if required.
+// Return true if padding was added
+func cgprecall(numArgs int) bool {
+	stackArgs := 0
+	if numArgs > MaxRegisterArgs {
+		stackArgs = numArgs - MaxRegisterArgs
+	}
+	pad := (pushDepth+stackArgs)%2 == 1
+	if pad {
+		write("\tsubq\t$8, %rsp\n")
+		pushDepth++
+	}
+	return pad
+}
+
+// Move the pointer to the function about to be called
+// out of the way of the arguments and free its register.
+// Return the operand to call it with
+func cgfuncpointer(r int) string {
+	writef("\tmovq\t%s, %%r11\n", reglist[r])
+	free_register(r)
+	return "*%r11"
+}
+
+// Call a function whose arguments have been pushed on the stack,
+// first argument on top. The target is the function's name or a
+// pointer operand from cgfuncpointer, and t is its return type.
+// Restore the spilled registers and return the register with the result
+func cgcall(target string, t *Type, numArgs int, pad bool, spilled []int) int {
+	// Pop the first arguments into their registers
+	for i := 0; i < numArgs && i < MaxRegisterArgs; i++ {
+		writef("\tpopq\t%s\n", paramreglist[i])
+		pushDepth--
+	}
+	writef("\tcall\t%s\n", target)
+	// Remove any remaining arguments and padding from the stack
+	extra := 0
+	if numArgs > MaxRegisterArgs {
+		extra = numArgs - MaxRegisterArgs
+	}
+	if pad {
+		extra++
+	}
+	if extra != 0 {
+		writef("\taddq\t$%d, %%rsp\n", 8*extra)
+		pushDepth -= extra
+	}
+	cgunspillregs(spilled)
+	if t.kind == KindVoid {
+		return NoReg
+	}
+	// Get a new register and copy the result into it
+	outr := alloc_register()
+	switch cgprimsize(t) {
+	case 1:
+		writef("\tmovzbq\t%%al, %s\n", reglist[outr])
+	case 4:
+		writef("\tmovslq\t%%eax, %s\n", reglist[outr])
+	default:
+		writef("\tmovq\t%%rax, %s\n", reglist[outr])
+	}
 	return outr
 }
 
 // Generate code to return a value from a function
 func cgreturn(reg int, sym *Symbol) {
-	// Generate code depending on the function's type
-	switch sym.t {
-	case NodeChar:
+	// Generate code depending on the function's return
+	// type. A void function has no value to return
+	switch cgprimsize(sym.t.base) {
+	case 0:
+		break
+	case 1:
 		writef("\tmovzbl\t%s, %%eax\n", breglist[reg])
 		break
-	case NodeInt:
+	case 4:
 		writef("\tmovl\t%s, %%eax\n", dreglist[reg])
 		break
-	case NodeLong:
+	case 8:
 		writef("\tmovq\t%s, %%rax\n", reglist[reg])
 		break
 	default:
-		fatal("Bad function type in cgreturn %v\n", sym.t)
+		fatal("Bad function type in cgreturn %v\n", sym.t.base)
 	}
 	cgjump(sym.endLabel)
 }
 
-// Generate code to load the address of a global
+// Generate code to load the address of an
 // identifier into a variable. Return a new register
 func cgaddress(sym *Symbol) int {
 	r := alloc_register()
-	writef("\tleaq\t%s(%%rip), %s\n", sym.name, reglist[r])
+	if sym.class == ClassGlobal {
+		writef("\tleaq\t%s(%%rip), %s\n", sym.name, reglist[r])
+	} else {
+		writef("\tleaq\t%d(%%rbp), %s\n", sym.posn, reglist[r])
+	}
 	return r
 }
 
-// Dereference a pointer to get the value it
-// pointing at into the same register
-func cgderef(r int, t NodeType) int {
-	switch t {
-	case NodeCharPointer:
+// Dereference a pointer to get the value of the
+// given type it points at into the same register
+func cgderef(r int, t *Type) int {
+	switch cgprimsize(t) {
+	case 1:
 		writef("\tmovzbq\t(%s), %s\n", reglist[r], reglist[r])
-	case NodeIntPointer, NodeLongPointer:
+	case 4:
+		writef("\tmovslq\t(%s), %s\n", reglist[r], reglist[r])
+	case 8:
 		writef("\tmovq\t(%s), %s\n", reglist[r], reglist[r])
+	default:
+		fatal("can't dereference a pointer to type %v\n", t)
+	}
+	return r
+}
+
+// Load the value of the given type that the pointer in
+// the register points at into a new register. The
+// pointer stays in its register
+func cgloadderef(r int, t *Type) int {
+	outr := alloc_register()
+	switch cgprimsize(t) {
+	case 1:
+		writef("\tmovzbq\t(%s), %s\n", reglist[r], reglist[outr])
+	case 4:
+		writef("\tmovslq\t(%s), %s\n", reglist[r], reglist[outr])
+	case 8:
+		writef("\tmovq\t(%s), %s\n", reglist[r], reglist[outr])
+	default:
+		fatal("can't dereference a pointer to type %v\n", t)
+	}
+	return outr
+}
+
+// Copy a register's value into a new register
+// and return the number of the new register
+func cgcopy(r int) int {
+	outr := alloc_register()
+	writef("\tmovq\t%s, %s\n", reglist[r], reglist[outr])
+	return outr
+}
+
+// Move a register's value into another
+// register and free the first one
+func cgmove(r1, r2 int) {
+	writef("\tmovq\t%s, %s\n", reglist[r1], reglist[r2])
+	free_register(r1)
+}
+
+// Cut a register's value down to the size of the type
+// and extend it back to 64 bits, as if it had been
+// stored in a variable of the type and loaded again
+func cgextend(r int, t *Type) int {
+	switch cgprimsize(t) {
+	case 1:
+		writef("\tmovzbq\t%s, %s\n", breglist[r], reglist[r])
+	case 4:
+		writef("\tmovslq\t%s, %s\n", dreglist[r], reglist[r])
+	}
+	return r
+}
+
+// Store the value in the first register through
+// the pointer in the second register
+func cgstorderef(r1, r2 int, t *Type) int {
+	switch cgprimsize(t) {
+	case 1:
+		writef("\tmovb\t%s, (%s)\n", breglist[r1], reglist[r2])
+	case 4:
+		writef("\tmovl\t%s, (%s)\n", dreglist[r1], reglist[r2])
+	case 8:
+		writef("\tmovq\t%s, (%s)\n", reglist[r1], reglist[r2])
+	default:
+		fatal("can't store through a pointer to type %v\n", t)
+	}
+	free_register(r2)
+	return r1
+}
+
+// Return log2 of the value if it is a power of two, else -1
+func powerOfTwo(value int) int {
+	if value <= 0 || value&(value-1) != 0 {
+		return -1
+	}
+	shift := 0
+	for value > 1 {
+		value >>= 1
+		shift++
+	}
+	return shift
+}
+
+// Negate a register's value
+func cgnegate(r int) int {
+	writef("\tnegq\t%s\n", reglist[r])
+	return r
+}
+
+// Invert the bits of a register's value
+func cginvert(r int) int {
+	writef("\tnotq\t%s\n", reglist[r])
+	return r
+}
+
+// Set a register to 1 if its value is zero, else 0
+func cglognot(r int) int {
+	writef("\ttestq\t%s, %s\n", reglist[r], reglist[r])
+	writef("\tsete\t%s\n", breglist[r])
+	writef("\tmovzbq\t%s, %s\n", breglist[r], reglist[r])
+	return r
+}
+
+// Multiply the register by a constant, shifting
+// instead if the constant is a power of two
+func cgscale(r, value int) int {
+	if shift := powerOfTwo(value); shift >= 0 {
+		writef("\tsalq\t$%d, %s\n", shift, reglist[r])
+	} else {
+		writef("\timulq\t$%d, %s\n", value, reglist[r])
+	}
+	return r
+}
+
+// Divide the register by a constant, shifting
+// instead if the constant is a power of two
+func cgunscale(r, value int) int {
+	if shift := powerOfTwo(value); shift >= 0 {
+		writef("\tsarq\t$%d, %s\n", shift, reglist[r])
+	} else {
+		writef("\tmovq\t%s, %%rax\n", reglist[r])
+		write("\tcqo\n")
+		writef("\tmovq\t$%d, %%rcx\n", value)
+		write("\tidivq\t%rcx\n")
+		writef("\tmovq\t%%rax, %s\n", reglist[r])
 	}
 	return r
 }
@@ -4,20 +4,25 @@ package main
 // variables or functions
 func globalDeclarations() {
 	for {
-		// We have to read past the type and identifier
-		// to see either a '(' for a function declaration
-		// or a ',' or ';' for a variable declaration.
-		// Text is filled in by the ident() call.
+		// We have to read past the type and the declarator
+		// to see if the declarator is for a function or
+		// for a list of variables.
 		t := parseType()
-		ident()
-		if CurrentToken.token == TokenLeftParen {
-			// Parse the function declaration and
-			// generate the assembly code for it
-			tree := functionDeclaration(t)
-			generateAST(tree, NoReg, 0)
+		if CurrentToken.token == TokenSemicolon {
+			// Only a struct or union was declared
+			scan(CurrentToken)
 		} else {
-			// Parse the global variable declaration
-			varDeclaration(t)
+			d := parseDeclarator(t)
+			if d.t.kind == KindFunction {
+				// Parse the function declaration and generate
+				// the assembly code for it, unless it was a prototype
+				if tree := functionDeclaration(d); tree != nil {
+					generateAST(tree, NoReg)
+				}
+			} else {
+				// Parse the global variable declaration
+				varDeclaration(t, d, ClassGlobal)
+			}
 		}
 		// Stop when we have reached EOF
 		if CurrentToken.token == TokenEOF {
@@ -26,58 +31,393 @@ func globalDeclarations() {
 	}
 }
 
-// Parse the declaration of a list of variables.
-// The identifier has been scanned & we have the type
-func varDeclaration(t NodeType) {
+// A declarator names the thing being declared and gives its type
+type declarator struct {
+	name   string
+	t      *Type
+	params []*Symbol // For a function, its parameters with their names
+}
+
+// A derivation is one step in building a declarator's
+// type from its base type: a pointer, array or function
+type derivation struct {
+	kind       TypeKind
+	qualifiers Qualifier // For pointers
+	length     int       // For arrays
+	params     []*Symbol // For functions
+}
+
+// Parse a declarator after the base type of a declaration: the
+// name being declared, surrounded by any number of '*'s, array
+// sizes, parameter lists and parentheses. The name is missing
+// for an abstract declarator, e.g. a parameter in a prototype
+func parseDeclarator(base *Type) declarator {
+	name, derivations, params := declaratorParts()
+	t := base
+	for _, d := range derivations {
+		switch d.kind {
+		case KindPointer:
+			t = qualified(pointerTo(t), d.qualifiers)
+		case KindArray:
+			if t.kind == KindFunction || genprimsize(t) == 0 {
+				fatal("array of incomplete type %s on line %d\n", t, Line)
+			}
+			t = arrayOf(t, d.length)
+		case KindFunction:
+			if t.kind == KindFunction || t.kind == KindArray {
+				fatal("function can't return %s on line %d\n", t, Line)
+			}
+			if t.isComposite() {
+				fatal("can't return a struct or union by value on line %d\n", Line)
+			}
+			types := make([]*Type, len(d.params))
+			for i, p := range d.params {
+				types[i] = p.t
+			}
+			t = functionOf(t, types)
+		}
+	}
+	return declarator{name: name, t: t, params: params}
+}
+
+// Parse the parts of a declarator. Return the name, the
+// derivations to apply to the base type in order, and the
+// parameters if the name is declared directly as a function
+func declaratorParts() (string, []derivation, []*Symbol) {
+	var pointers, suffixes, inner []derivation
+	var params []*Symbol
+	name := ""
+	nested := false
+	// Each '*' can be followed by its own qualifiers
+	for CurrentToken.token == TokenStar {
+		scan(CurrentToken)
+		pointers = append(pointers, derivation{kind: KindPointer, qualifiers: parseQualifiers()})
+	}
+	switch CurrentToken.token {
+	case TokenLeftParen:
+		// A parenthesised declarator binds more
+		// tightly than the suffixes which follow it
+		scan(CurrentToken)
+		name, inner, params = declaratorParts()
+		nested = true
+		rparen()
+	case TokenIdent:
+		name = Text
+		scan(CurrentToken)
+	}
+	// Get the array sizes and parameter lists
+	for {
+		if CurrentToken.token == TokenLeftBracket {
+			suffixes = append(suffixes, derivation{kind: KindArray, length: arraySize()})
+		} else if CurrentToken.token == TokenLeftParen {
+			scan(CurrentToken)
+			suffixes = append(suffixes, derivation{kind: KindFunction, params: paramDeclarationList()})
+			rparen()
+		} else {
+			break
+		}
+	}
+	if !nested && len(suffixes) > 0 && suffixes[0].kind == KindFunction {
+		params = suffixes[0].params
+	}
+	// The pointers apply to the base type first, then the suffixes
+	// from right to left, then the parenthesised declarator
+	derivations := pointers
+	for i := len(suffixes) - 1; i >= 0; i-- {
+		derivations = append(derivations, suffixes[i])
+	}
+	return name, append(derivations, inner...), params
+}
+
+// Parse the declaration of a list of variables. The base
+// type and the first declarator have already been parsed.
+// Return the AST tree which assigns the initial values of
+// local variables, or nil if there are none
+func varDeclaration(t *Type, d declarator, class StorageClass) *ASTNode {
+	var tree *ASTNode
 	for {
-		// Text now has the identifier's name.
-		// Add it as a known identifier
-		// and generate its space in assembly
-		sym := AddSymbol(Text, t, NodeVariable, 0)
-		genglobsym(sym)
+		if d.name == "" {
+			fatal("missing variable name on line %d\n", Line)
+		}
+		if d.t.kind == KindFunction {
+			fatal("can't declare function %s here on line %d\n", d.name, Line)
+		}
+		if genprimsize(d.t) == 0 {
+			fatal("variable %s has incomplete type %s on line %d\n", d.name, d.t, Line)
+		}
+		// Add it as a known identifier. Globals have
+		// their space generated in assembly now, locals
+		// get a stack slot when the function is generated
+		sym := AddSymbol(d.name, d.t, NodeVariable, class, 0)
+		// Get the initial value, if any
+		var init *ASTNode
+		if CurrentToken.token == TokenAssign {
+			scan(CurrentToken)
+			init = initializer(sym)
+		}
+		if class == ClassLocal {
+			fn := GetSymbolByID(FunctionId)
+			fn.locals = append(fn.locals, sym)
+			// A local is initialised by assigning to it
+			if init != nil {
+				init = assign(init, NewLeafASTNode(OpLvIdent, sym.t, sym.id))
+				if tree == nil {
+					tree = init
+				} else {
+					tree = NewASTNode(OpGlue, nil, tree, nil, init, 0)
+				}
+			}
+		} else {
+			genglobsym(sym, init)
+		}
 		// If the next token is a semicolon,
 		// skip it and return.
 		if CurrentToken.token == TokenSemicolon {
 			scan(CurrentToken)
-			return
+			return tree
 		}
 		// If the next token is a comma, skip it,
-		// get the identifier and loop back
+		// get the next declarator and loop back
 		if CurrentToken.token == TokenComma {
 			scan(CurrentToken)
-			ident()
+			d = parseDeclarator(t)
 			continue
 		}
 		fatal("Missing , or ; after identifier\n")
 	}
 }
 
-// Parse the declaration of a simplistic function.
-// The identifier has been scanned & we have the type
-func functionDeclaration(t NodeType) *ASTNode {
-	// Get a label-id for the end label, add the function
-	// to the symbol table, and set the Functionid global
-	// to the function's symbol-id
-	sym := AddSymbol(Text, t, NodeFunction, label())
+// Parse the expression which gives a variable its initial
+// value and return its AST tree. A global's initial value
+// must be a constant
+func initializer(sym *Symbol) *ASTNode {
+	if !sym.t.isScalar() {
+		fatal("can't initialise %s of type %s on line %d\n", sym.name, sym.t, Line)
+	}
+	tree := binexpr(0)
+	if sym.class == ClassGlobal {
+		if tree.op != OpIntLiteral && tree.op != OpStringLiteral {
+			fatal("initial value of %s is not a constant on line %d\n", sym.name, Line)
+		}
+		if _, _, ok := typeCompatible(tree.t, sym.t, true); !ok {
+			fatal("incompatible type %s to initialise %s on line %d\n", tree.t, sym.name, Line)
+		}
+	}
+	return tree
+}
+
+// Parse the '[' size ']' of an array declarator and
+// return the size, or -1 if the size is left out
+func arraySize() int {
+	// Skip past the '['
+	scan(CurrentToken)
+	if CurrentToken.token == TokenRightBracket {
+		scan(CurrentToken)
+		return -1
+	}
+	if CurrentToken.token != TokenIntLiteral || CurrentToken.value <= 0 {
+		fatal("array size must be a positive integer on line %d\n", Line)
+	}
+	size := CurrentToken.value
+	scan(CurrentToken)
+	match(TokenRightBracket, "]")
+	return size
+}
+
+// Parse a struct or union type after the 'struct' or 'union'
+// keyword, which is either a reference to a type declared
+// earlier or a new definition, and return the type
+func compositeDeclaration(union bool) *Type {
+	kind, tkind := "struct", KindStruct
+	if union {
+		kind, tkind = "union", KindUnion
+	}
+	// Skip the keyword and get the optional tag
+	scan(CurrentToken)
+	name := ""
+	if CurrentToken.token == TokenIdent {
+		name = Text
+		scan(CurrentToken)
+	}
+	// Without a '{', this is a reference to an existing type
+	if CurrentToken.token != TokenLeftBrace {
+		t := FindCompositeType(name, false)
+		if t == nil {
+			fatal("unknown %s %s on line %d\n", kind, name, Line)
+		}
+		if t.kind != tkind {
+			fatal("%s used as a %s on line %d, previously declared on line %d\n", name, kind, Line, t.composite.line)
+		}
+		return t
+	}
+	// A definition hides any type with the same
+	// tag in an enclosing scope
+	if t := FindCompositeType(name, true); t != nil {
+		fatal("redefinition of %s %s on line %d, previously declared on line %d\n", kind, name, Line, t.composite.line)
+	}
+	// Add the type before its members are parsed,
+	// so that they can point to the type itself
+	ctype := &Composite{name: name, line: Line}
+	t := &Type{kind: tkind, composite: ctype}
+	if name != "" {
+		AddCompositeType(t)
+	}
+	lbrace()
+	for CurrentToken.token != TokenRightBrace {
+		mt := parseType()
+		for {
+			// Get each member's declarator
+			d := parseDeclarator(mt)
+			if d.name == "" {
+				fatal("member name expected on line %d\n", Line)
+			}
+			if ctype.member(d.name) != nil {
+				fatal("duplicate member %s in %s on line %d\n", d.name, kind, Line)
+			}
+			member := &Symbol{name: d.name, t: d.t, st: NodeVariable, class: ClassMember, line: Line}
+			ctype.members = append(ctype.members, member)
+			if CurrentToken.token != TokenComma {
+				break
+			}
+			scan(CurrentToken)
+		}
+		semi()
+	}
+	rbrace()
+	if len(ctype.members) == 0 {
+		fatal("%s %s has no members on line %d\n", kind, name, Line)
+	}
+	layoutComposite(t)
+	return t
+}
+
+// Work out the offset of each member of a struct or union,
+// and the size and alignment of the whole type. The size is
+// padded so that the members stay aligned in an array
+func layoutComposite(t *Type) {
+	ctype := t.composite
+	offset, size, align := 0, 0, 1
+	for _, m := range ctype.members {
+		msize := genprimsize(m.t)
+		if msize == 0 || m.t.kind == KindFunction {
+			fatal("member %s has incomplete type %s on line %d\n", m.name, m.t, m.line)
+		}
+		malign := genalign(m.t)
+		if malign > align {
+			align = malign
+		}
+		if t.kind == KindUnion {
+			// All the members of a union start at the beginning
+			m.posn = 0
+			if msize > size {
+				size = msize
+			}
+		} else {
+			offset = (offset + malign - 1) &^ (malign - 1)
+			m.posn = offset
+			offset += msize
+			size = offset
+		}
+	}
+	ctype.size = (size + align - 1) &^ (align - 1)
+	ctype.align = align
+}
+
+// Parse the parameters in parentheses in a function declarator
+// and return them in declaration order. They are not added to
+// the symbol table, and the names may be missing in a prototype
+func paramDeclarationList() []*Symbol {
+	var params []*Symbol
+	// Loop until the final right parentheses
+	for CurrentToken.token != TokenRightParen {
+		// Get the type and declarator
+		t := parseType()
+		// A lone 'void' means there are no parameters
+		if t.kind == KindVoid && len(params) == 0 && CurrentToken.token == TokenRightParen {
+			break
+		}
+		d := parseDeclarator(t)
+		// Array and function parameters are really pointers
+		switch d.t.kind {
+		case KindArray:
+			d.t = pointerTo(d.t.base)
+		case KindFunction:
+			d.t = pointerTo(d.t)
+		case KindStruct, KindUnion:
+			fatal("can't pass a struct or union by value on line %d\n", Line)
+		case KindVoid:
+			fatal("parameter can't be void on line %d\n", Line)
+		}
+		params = append(params, &Symbol{name: d.name, t: d.t, st: NodeVariable, class: ClassParam, line: Line})
+		// Must have a ',' or ')' at this point
+		switch CurrentToken.token {
+		case TokenComma:
+			scan(CurrentToken)
+		case TokenRightParen:
+		default:
+			fatal("unexpected token in parameter list on line %d\n", Line)
+		}
+	}
+	return params
+}
+
+// Parse the declaration of a function, which is either a
+// prototype ending in ';' or a definition with a body.
+// The declarator has been parsed.
+// Return nil for a prototype, as there is no code for it
+func functionDeclaration(d declarator) *ASTNode {
+	// If the function has been declared before,
+	// the declarations must agree. Otherwise get a
+	// label-id for the end label and add the function
+	// to the symbol table
+	sym := FindGlobalSymbol(d.name)
+	if sym != nil {
+		if sym.st != NodeFunction || !sym.t.base.equal(d.t.base) {
+			fatal("conflicting declaration of %s on line %d, previously declared on line %d\n", sym.name, Line, sym.line)
+		}
+		if !sym.t.equal(d.t) {
+			fatal("conflicting parameters for %s on line %d, previously declared on line %d\n", sym.name, Line, sym.line)
+		}
+	} else {
+		sym = AddSymbol(d.name, d.t, NodeFunction, ClassGlobal, label())
+	}
+	// A prototype has no body
+	if CurrentToken.token == TokenSemicolon {
+		scan(CurrentToken)
+		return nil
+	}
+	if sym.defined {
+		fatal("redefinition of %s on line %d, previously defined on line %d\n", sym.name, Line, sym.defLine)
+	}
+	sym.defined, sym.defLine = true, Line
+	// The parameters are declared in the function's own
+	// scope, which is also the scope of its body
+	PushScope()
+	for _, p := range d.params {
+		if p.name == "" {
+			fatal("parameter name omitted in definition of %s on line %d\n", sym.name, Line)
+		}
+		sym.params = append(sym.params, AddSymbol(p.name, p.t, NodeVariable, ClassParam, 0))
+	}
+	// Set the FunctionId global to the function's symbol-id
 	FunctionId = sym.id
-	// Scan in the parentheses
-	lparen()
-	rparen()
 	// Get the AST tree for the compound statement
-	tree := compoundStatement()
-	// If the function type isn't P_VOID, check that
-	// the last AST operation in the compound statement
-	// was a return statement
-	if t != NodeVoid {
-		finalstmt := tree
-		if tree.op == OpGlue {
-			finalstmt = tree.right
-		}
-		if finalstmt == nil || finalstmt.op != OpReturn {
-			fatal("No return for function with non-void type\n")
+	tree := compoundStatement(false)
+	// The body is parsed, so the parameters go out of scope
+	PopScope()
+	EndLabels()
+	// If the function type isn't P_VOID, warn if control
+	// can reach the end of the body without a return.
+	// main returns zero instead, as in C99
+	if sym.t.base.kind != KindVoid && reachesEnd(tree, true) {
+		if sym.name == "main" {
+			zero := NewLeafASTNode(OpIntLiteral, sym.t.base, 0)
+			tree = glue(tree, NewUnaryASTNode(OpReturn, nil, zero, 0))
+		} else {
+			warning("control reaches the end of non-void function %s defined on line %d\n", sym.name, sym.defLine)
 		}
 	}
 	// Return an A_FUNCTION node which has the function's nameslot
 	// and the compound statement sub-tree
-	return NewUnaryASTNode(OpFunction, t, tree, sym.id)
+	return NewUnaryASTNode(OpFunction, sym.t, tree, sym.id)
 }
@@ -1,27 +1,60 @@
 package main
 
+import "math"
+
 // Given an AST, interpret the
 // operators in it and return
 // a final value.
-func generateAST(node *ASTNode, reg int, parentASTOp OpType) int {
+func generateAST(node *ASTNode, reg int) int {
+	// An empty statement has no AST
+	if node == nil {
+		return NoReg
+	}
 	switch node.op {
 	case OpIf:
 		return genIFAST(node)
 	case OpWhile:
 		return genWHILE(node)
+	case OpDoWhile:
+		return genDoWhile(node)
+	case OpBreak:
+		cgjump(breakLabels[len(breakLabels)-1])
+		return NoReg
+	case OpContinue:
+		cgjump(continueLabels[len(continueLabels)-1])
+		return NoReg
+	case OpSwitch:
+		return genSWITCH(node)
+	case OpLabel:
+		cglabel(node.value)
+		return NoReg
+	case OpGoto:
+		cgjump(node.value)
+		return NoReg
 	case OpGlue:
 		// Do each child statement, and free the
 		// registers after each child
-		generateAST(node.left, NoReg, node.op)
+		generateAST(node.left, NoReg)
 		genfreeregs()
-		generateAST(node.right, NoReg, node.op)
+		generateAST(node.right, NoReg)
 		genfreeregs()
 		return NoReg
+	case OpFunctionCall:
+		return genFunctionCall(node)
+	case OpLogicalAnd, OpLogicalOr:
+		return genLogical(node)
+	case OpCompoundAssign, OpPostIncrement, OpPostDecrement:
+		return genModify(node)
+	case OpTernary:
+		return genTernary(node)
 	case OpFunction:
 		// Generate the function's preamble before the code
 		sym := GetSymbolByID(node.value)
-		cgfuncpreamble(sym.name)
-		generateAST(node.left, NoReg, node.op)
+		cgfuncpreamble(sym)
+		generateAST(node.left, NoReg)
+		// A body of one statement isn't glued,
+		// so free its registers here
+		genfreeregs()
 		cgfuncpostamble(sym)
 		return NoReg
 	}
@@ -29,40 +62,40 @@ func generateAST(node *ASTNode, reg int, parentASTOp OpType) int {
 	leftreg, rightreg := 0, 0
 	// Get the left and right sub-tree values
 	if node.left != nil {
-		leftreg = generateAST(node.left, NoReg, node.op)
+		leftreg = generateAST(node.left, NoReg)
 	}
 	if node.right != nil {
-		rightreg = generateAST(node.right, leftreg, node.op)
+		rightreg = generateAST(node.right, leftreg)
 	}
 
 	switch node.op {
-	case OpAdd:
-		return cgadd(leftreg, rightreg)
-	case OpSubtract:
-		return cgsub(leftreg, rightreg)
-	case OpMultiply:
-		return cgmul(leftreg, rightreg)
-	case OpDivide:
-		return cgdiv(leftreg, rightreg)
+	case OpAdd, OpSubtract, OpMultiply, OpDivide, OpModulo, OpAnd, OpOr, OpXor, OpLeftShift, OpRightShift:
+		return genbinop(node.op, leftreg, rightreg, node.t)
 	case OpEqual, OpNotEqual, OpLessThan, OpGreaterThan, OpLessThanOrEqual, OpGreaterThanOrEqual:
-		// If the parent AST node is an A_IF, generate a compare
-		// followed by a jump. Otherwise, compare registers and
-		// set one to 1 or 0 based on the comparison.
-		if parentASTOp == OpIf || parentASTOp == OpWhile {
-			return cgcompare_and_jump(node.op, leftreg, rightreg, reg)
-		}
+		// Compare registers and set one to 1 or 0
+		// based on the comparison. Conditions use
+		// genCondition to compare and jump instead
 		return cgcompare_and_set(node.op, leftreg, rightreg)
 	case OpIntLiteral:
 		return cgloadint(node.value)
+	case OpStringLiteral:
+		return cgloadglobstr(node.value)
 	case OpIdent:
 		sym := GetSymbolByID(node.value)
-		return cgloadglob(sym)
+		if sym.class == ClassGlobal {
+			return cgloadglob(sym)
+		}
+		return cgloadlocal(sym)
 	case OpLvIdent:
 		sym := GetSymbolByID(node.value)
-		return cgstorglob(reg, sym)
+		if sym.class == ClassGlobal {
+			return cgstorglob(reg, sym)
+		}
+		return cgstorlocal(reg, sym)
 	case OpAssign:
-		// The work has already been done, return the result
-		return rightreg
+		// The work has already been done. The result is the
+		// value as it was stored, cut down to the lvalue's type
+		return cgextend(rightreg, node.t)
 	case OpPrint:
 		// Print the left-child's value
 		// and return no register
@@ -76,26 +109,110 @@ func generateAST(node *ASTNode, reg int, parentASTOp OpType) int {
 		sym := GetSymbolByID(FunctionId)
 		cgreturn(leftreg, sym)
 		return NoReg
-	case OpFunctionCall:
-		sym := GetSymbolByID(node.value)
-		return cgcall(leftreg, sym)
 
 	case OpAddress:
 		sym := GetSymbolByID(node.value)
 		return cgaddress(sym)
 	case OpDereference:
-		return cgderef(leftreg, node.left.t)
+		return cgderef(leftreg, node.t)
+	case OpLvDereference:
+		// Store the value in reg through the pointer in leftreg
+		return cgstorderef(reg, leftreg, node.t)
+	case OpNegate:
+		return cgnegate(leftreg)
+	case OpInvert:
+		return cginvert(leftreg)
+	case OpLogicalNot:
+		return cglognot(leftreg)
+	case OpScale:
+		return cgscale(leftreg, node.value)
+	case OpUnscale:
+		return cgunscale(leftreg, node.value)
 	default:
 		fatal("unknown AST operator %d\n", node.op)
 		return 0
 	}
 }
 
+// Apply a binary arithmetic operation of the given type
+// to two registers and return the register with the result
+func genbinop(op OpType, leftreg, rightreg int, t *Type) int {
+	switch op {
+	case OpAdd:
+		return cgadd(leftreg, rightreg)
+	case OpSubtract:
+		return cgsub(leftreg, rightreg)
+	case OpMultiply:
+		return cgmul(leftreg, rightreg)
+	case OpDivide, OpModulo:
+		return cgdivmod(op, leftreg, rightreg, t)
+	case OpAnd:
+		return cgand(leftreg, rightreg)
+	case OpOr:
+		return cgor(leftreg, rightreg)
+	case OpXor:
+		return cgxor(leftreg, rightreg)
+	case OpLeftShift:
+		return cgshl(leftreg, rightreg)
+	case OpRightShift:
+		return cgshr(leftreg, rightreg)
+	}
+	fatal("unknown binary operator %d\n", op)
+	return NoReg
+}
+
+// Generate the code which changes an lvalue in place, for a
+// compound assignment, x++ or x--. The address of a dereferenced
+// pointer is only worked out once. Return the register with
+// the value of the expression
+func genModify(node *ASTNode) int {
+	target := node.left
+	addr := NoReg
+	var value int
+	if target.op == OpDereference {
+		addr = generateAST(target.left, NoReg)
+		value = cgloadderef(addr, target.t)
+	} else {
+		value = generateAST(target, NoReg)
+	}
+	result := value
+	switch node.op {
+	case OpCompoundAssign:
+		value = genbinop(OpType(node.value), value, generateAST(node.right, NoReg), target.t)
+		result = value
+	case OpPostIncrement:
+		// Keep the value from before the change
+		result = cgcopy(value)
+		value = cgadd(cgloadint(node.value), value)
+	case OpPostDecrement:
+		result = cgcopy(value)
+		value = cgsub(value, cgloadint(node.value))
+	}
+	// Store the new value with the target's size
+	value = cgextend(value, target.t)
+	if addr != NoReg {
+		cgstorderef(value, addr, target.t)
+	} else if sym := GetSymbolByID(target.value); sym.class == ClassGlobal {
+		cgstorglob(value, sym)
+	} else {
+		cgstorlocal(value, sym)
+	}
+	if result != value {
+		free_register(value)
+	}
+	return result
+}
+
 func genpreamble() {
 	cgpreamble()
 }
 
 func genpostamble() {
+	// The string literals go in the read-only data section
+	cgrodata()
+	for _, s := range stringLiterals {
+		cgglobstr(stringLabels[s], s)
+	}
 	cgpostamble()
 }
 
@@ -107,14 +224,139 @@ func genprintint(reg int) {
 	cgprintint(reg)
 }
 
-func genglobsym(s *Symbol) {
-	cgglobsym(s)
+func genglobsym(s *Symbol, init *ASTNode) {
+	cgglobsym(s, init)
 }
 
-func genprimsize(t NodeType) int {
+// The string literals in the program, in the order
+// they were first seen, and the label of each one
+var (
+	stringLiterals []string
+	stringLabels   = make(map[string]int)
+)
+
+// Return the label of a string literal. Identical
+// string literals share the same label
+func genglobstr(s string) int {
+	if l, ok := stringLabels[s]; ok {
+		return l
+	}
+	l := label()
+	stringLiterals = append(stringLiterals, s)
+	stringLabels[s] = l
+	return l
+}
+
+func genprimsize(t *Type) int {
 	return cgprimsize(t)
 }
 
+func genalign(t *Type) int {
+	return cgalign(t)
+}
+
+// Generate the code to call a function. Any registers in use
+// are spilled across the call. The arguments are evaluated from
+// last to first and pushed on the stack, so that the first six
+// can be popped into their registers and the rest stay on the
+// stack in the order that the System V ABI expects. A call
+// through a pointer has the pointer as its middle child
+func genFunctionCall(node *ASTNode) int {
+	spilled := cgspillregs()
+	// The top OpGlue node holds the last argument,
+	// and its value is the number of arguments
+	numArgs := 0
+	if node.left != nil {
+		numArgs = node.left.value
+	}
+	pad := cgprecall(numArgs)
+	for glue := node.left; glue != nil; glue = glue.left {
+		reg := generateAST(glue.right, NoReg)
+		cgpush(reg)
+	}
+	var target string
+	if node.middle != nil {
+		target = cgfuncpointer(generateAST(node.middle, NoReg))
+	} else {
+		target = GetSymbolByID(node.value).name
+	}
+	return cgcall(target, node.t, numArgs, pad, spilled)
+}
+
+// The comparison which is true when the key is false
+var negatedComparison = map[OpType]OpType{
+	OpEqual:              OpNotEqual,
+	OpNotEqual:           OpEqual,
+	OpLessThan:           OpGreaterThanOrEqual,
+	OpGreaterThanOrEqual: OpLessThan,
+	OpGreaterThan:        OpLessThanOrEqual,
+	OpLessThanOrEqual:    OpGreaterThan,
+}
+
+// Generate the code for a condition which jumps to
+// the label if the condition is true, or if jumpIfTrue
+// is false, if it is false. Otherwise the code carries
+// on. The right side of && and || is skipped if the
+// left side decides the outcome
+func genCondition(node *ASTNode, l int, jumpIfTrue bool) {
+	switch node.op {
+	case OpLogicalAnd, OpLogicalOr:
+		if (node.op == OpLogicalOr) == jumpIfTrue {
+			// Either side can decide to jump
+			genCondition(node.left, l, jumpIfTrue)
+			genCondition(node.right, l, jumpIfTrue)
+		} else {
+			// The left side can decide not to jump,
+			// in which case the right side is skipped
+			Lskip := label()
+			genCondition(node.left, Lskip, !jumpIfTrue)
+			genCondition(node.right, l, jumpIfTrue)
+			cglabel(Lskip)
+		}
+	case OpLogicalNot:
+		// Jump on the opposite outcome of the operand
+		genCondition(node.left, l, !jumpIfTrue)
+	case OpEqual, OpNotEqual, OpLessThan, OpGreaterThan, OpLessThanOrEqual, OpGreaterThanOrEqual:
+		// Compare and jump in one go
+		op := node.op
+		if jumpIfTrue {
+			op = negatedComparison[op]
+		}
+		leftreg := generateAST(node.left, NoReg)
+		rightreg := generateAST(node.right, leftreg)
+		cgcompare_and_jump(op, leftreg, rightreg, l)
+	default:
+		cgtest_and_jump(generateAST(node, NoReg), jumpIfTrue, l)
+	}
+}
+
+// Generate the code for && or || whose value
+// is needed, and return the register with 1 or 0
+func genLogical(node *ASTNode) int {
+	// Jump when the outcome is known to be
+	// false for &&, or true for ||
+	Ldecided, Lend := label(), label()
+	decided := node.op == OpLogicalOr
+	genCondition(node, Ldecided, decided)
+	return cgshortcircuit(decided, Ldecided, Lend)
+}
+
+// Generate the code for a ternary expression. Only
+// one arm is evaluated, and both leave their value
+// in the same register, which is returned
+func genTernary(node *ASTNode) int {
+	Lfalse, Lend := label(), label()
+	genCondition(node.left, Lfalse, false)
+	reg := generateAST(node.middle, NoReg)
+	cgjump(Lend)
+	// The register is still allocated, so the
+	// false arm can't choose it for its value
+	cglabel(Lfalse)
+	cgmove(generateAST(node.right, NoReg), reg)
+	cglabel(Lend)
+	return reg
+}
+
 var currentLabelId int
 
 // Generate and return a new label number
@@ -137,12 +379,11 @@ func genIFAST(node *ASTNode) int {
 		Lend = label()
 	}
 	// Generate the condition code followed
-	// by a zero jump to the false label.
-	// We cheat by sending the Lfalse label as a register.
-	generateAST(node.left, Lfalse, node.op)
+	// by a jump to the false label.
+	genCondition(node.left, Lfalse, false)
 	genfreeregs()
 	// Generate the true compound statement
-	generateAST(node.middle, NoReg, node.op)
+	generateAST(node.middle, NoReg)
 	genfreeregs()
 	// If there is an optional ELSE clause,
 	// generate the jump to skip to the end
@@ -155,7 +396,7 @@ func genIFAST(node *ASTNode) int {
 	// false compound statement and the
 	// end label
 	if node.right != nil {
-		generateAST(node.right, NoReg, node.op)
+		generateAST(node.right, NoReg)
 		genfreeregs()
 		cglabel(Lend)
 	}
@@ -170,18 +411,127 @@ func genWHILE(n *ASTNode) int {
 	// and output the start label
 	Lstart = label()
 	Lend = label()
+	// A continue in a FOR loop goes to the post-op
+	Lcontinue := Lstart
+	if n.middle != nil {
+		Lcontinue = label()
+	}
+	pushLoop(Lcontinue, Lend)
 	cglabel(Lstart)
 	// Generate the condition code followed
-	// by a jump to the end label.
-	// We cheat by sending the Lfalse label as a register.
-	generateAST(n.left, Lend, n.op)
-	genfreeregs()
+	// by a jump to the end label. A FOR
+	// loop without a condition has none
+	if n.left != nil {
+		genCondition(n.left, Lend, false)
+		genfreeregs()
+	}
 	// Generate the compound statement for the body
-	generateAST(n.right, NoReg, n.op)
+	generateAST(n.right, NoReg)
 	genfreeregs()
+	// Then any post-op
+	if n.middle != nil {
+		cglabel(Lcontinue)
+		generateAST(n.middle, NoReg)
+		genfreeregs()
+	}
 	// Finally output the jump back to the condition,
 	// and the end label
 	cgjump(Lstart)
 	cglabel(Lend)
+	popLoop()
 	return (NoReg)
 }
+
+// Generate the code for a DO WHILE statement,
+// which tests the condition after the body
+func genDoWhile(n *ASTNode) int {
+	Lstart, Lcontinue, Lend := label(), label(), label()
+	pushLoop(Lcontinue, Lend)
+	cglabel(Lstart)
+	generateAST(n.right, NoReg)
+	genfreeregs()
+	// A continue goes to the condition, which
+	// jumps back to the start if it is true
+	cglabel(Lcontinue)
+	genCondition(n.left, Lstart, true)
+	genfreeregs()
+	cglabel(Lend)
+	popLoop()
+	return NoReg
+}
+
+// Generate the code for a SWITCH statement. Dense cases
+// jump through a table indexed by the value, and sparse
+// ones are compared against the value one at a time
+func genSWITCH(n *ASTNode) int {
+	Lend := label()
+	Ldefault := Lend
+	var cases []*ASTNode
+	labels := make(map[*ASTNode]int)
+	low, high := 0, 0
+	for c := n.right; c != nil; c = c.right {
+		labels[c] = label()
+		if c.op == OpDefault {
+			Ldefault = labels[c]
+			continue
+		}
+		if len(cases) == 0 || c.value < low {
+			low = c.value
+		}
+		if len(cases) == 0 || c.value > high {
+			high = c.value
+		}
+		cases = append(cases, c)
+	}
+	reg := generateAST(n.left, NoReg)
+	// Use a table when there are enough cases to beat a
+	// compare chain and at least a third of its entries
+	// are used. The values must fit in an instruction
+	span := high - low + 1
+	if len(cases) >= 4 && span > 0 && span <= 3*len(cases) &&
+		low >= math.MinInt32 && high <= math.MaxInt32 {
+		table := make([]int, span)
+		for i := range table {
+			table[i] = Ldefault
+		}
+		for _, c := range cases {
+			table[c.value-low] = labels[c]
+		}
+		cgjumptable(reg, low, table, label(), Ldefault)
+	} else {
+		for _, c := range cases {
+			cgcase_and_jump(reg, c.value, labels[c])
+		}
+		cgjump(Ldefault)
+	}
+	genfreeregs()
+	// Generate each case's statements in order, so
+	// that each one falls through into the next
+	breakLabels = append(breakLabels, Lend)
+	for c := n.right; c != nil; c = c.right {
+		cglabel(labels[c])
+		if c.left != nil {
+			generateAST(c.left, NoReg)
+			genfreeregs()
+		}
+	}
+	breakLabels = breakLabels[:len(breakLabels)-1]
+	cglabel(Lend)
+	return NoReg
+}
+
+// The labels which a break and a continue jump
+// to, with the innermost loop's labels last
+var breakLabels, continueLabels []int
+
+// Enter a loop with the given labels
+func pushLoop(Lcontinue, Lbreak int) {
+	continueLabels = append(continueLabels, Lcontinue)
+	breakLabels = append(breakLabels, Lbreak)
+}
+
+// Leave the innermost loop
+func popLoop() {
+	continueLabels = continueLabels[:len(continueLabels)-1]
+	breakLabels = breakLabels[:len(breakLabels)-1]
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strings"
 )
 
 var (
@@ -12,15 +13,28 @@ var (
 )
 
 func main() {
-	if len(os.Args) != 2 {
-		fatal(fmt.Sprintf("usage: %s infile\n", os.Args[0]))
+	// Get the -I include directories and the input file
+	inName := ""
+	for i := 1; i < len(os.Args); i++ {
+		arg := os.Args[i]
+		switch {
+		case arg == "-I" && i+1 < len(os.Args):
+			i++
+			IncludeDirs = append(IncludeDirs, os.Args[i])
+		case strings.HasPrefix(arg, "-I") && len(arg) > 2:
+			IncludeDirs = append(IncludeDirs, arg[2:])
+		case inName == "" && !strings.HasPrefix(arg, "-"):
+			inName = arg
+		default:
+			inName = ""
+			i = len(os.Args)
+		}
 	}
-	inFile, err := os.Open(os.Args[1])
-	if err != nil {
-		fatal("unable to open file %s: %v\n", os.Args[1], err)
+	if inName == "" {
+		fatal("usage: %s [-I dir]... infile\n", os.Args[0])
 	}
-	defer inFile.Close()
-	InFile = bufio.NewReader(inFile)
+	// The scanner reads the preprocessed input
+	InFile = bufio.NewReader(strings.NewReader(preprocess(inName)))
 
 	outFile, err := os.Create("out.s")
 	if err != nil {
@@ -29,8 +43,10 @@ func main() {
 	defer outFile.Close()
 	OutFile = bufio.NewWriter(outFile)
 
-	// For now, ensure that void printint() is defined
-	AddSymbol("printint", NodeChar, NodeFunction, 0)
+	// For now, ensure that void printint(int x) is defined.
+	// Its body is part of the assembly preamble
+	printint := AddSymbol("printint", functionOf(TypeChar, []*Type{TypeInt}), NodeFunction, ClassGlobal, 0)
+	printint.defined = true
 
 	scan(CurrentToken)   // Get the first token from the input
 	genpreamble()        // Output the preamble
@@ -42,7 +58,20 @@ func main() {
 	}
 }
 
+// Print an error, with the name of the file
+// being read if there is one, and stop
 func fatal(s string, args ...interface{}) {
+	if Filename != "" {
+		fmt.Fprintf(os.Stderr, "%s: ", Filename)
+	}
 	fmt.Fprintf(os.Stderr, s, args...)
 	os.Exit(1)
 }
+
+// Print a warning and carry on
+func warning(s string, args ...interface{}) {
+	if Filename != "" {
+		fmt.Fprintf(os.Stderr, "%s: ", Filename)
+	}
+	fmt.Fprintf(os.Stderr, "warning: "+s, args...)
+}
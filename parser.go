@@ -5,20 +5,30 @@ var (
 	RejectedToken *Token
 )
 
-// Operator precedence for each token
+// Operator precedence for each token, in the same
+// order as C. The gaps leave room for more operators
 var OperatorPrecedence = map[TokenType]int{
 	TokenEOF:                0,
-	TokenPlus:               10,
-	TokenMinus:              10,
-	TokenStar:               20,
-	TokenSlash:              20,
 	TokenIntLiteral:         0,
-	TokenEqual:              30,
-	TokenNotEqual:           30,
-	TokenLessThan:           40,
-	TokenLessThanOrEqual:    40,
-	TokenGreaterThan:        40,
-	TokenGreaterThanOrEqual: 40,
+	TokenQuestion:           5,
+	TokenOr:                 10,
+	TokenAnd:                20,
+	TokenPipe:               30,
+	TokenCaret:              40,
+	TokenAmpersand:          50,
+	TokenEqual:              60,
+	TokenNotEqual:           60,
+	TokenLessThan:           70,
+	TokenLessThanOrEqual:    70,
+	TokenGreaterThan:        70,
+	TokenGreaterThanOrEqual: 70,
+	TokenLeftShift:          80,
+	TokenRightShift:         80,
+	TokenPlus:               90,
+	TokenMinus:              90,
+	TokenStar:               100,
+	TokenSlash:              100,
+	TokenPercent:            100,
 }
 
 // Check that we have a binary operator and
@@ -31,57 +41,280 @@ func OpPrecedence(t TokenType) int {
 	return prec
 }
 
-// Parse a function call with a single expression
-// argument and return its AST
-func funccall() *ASTNode {
-	// Check that the identifier has been defined,
-	// then make a leaf node for it. XXX Add structural type test
-	sym := GetSymbolByString(Text)
+// Parse a list of zero or more comma-separated expressions and
+// return an AST composed of OpGlue nodes, with the left child
+// being the sub-tree of previous expressions (or nil) and the
+// right child being the next expression. Each OpGlue node has
+// its value set to the expression's position in the list.
+// Each expression is checked against the parameter types of
+// the function type ft, which is being called by name
+func expressionList(ft *Type, name string) *ASTNode {
+	var tree *ASTNode
+	count := 0
+	// Loop until the final right parentheses
+	for CurrentToken.token != TokenRightParen {
+		if count == len(ft.params) {
+			fatal("too many arguments in call to %s on line %d\n", name, Line)
+		}
+		param := ft.params[count]
+		// Parse the next expression and ensure it
+		// is compatible with the parameter's type
+		child := binexpr(0)
+		leftOp, _, ok := typeCompatible(child.t, param, true)
+		if !ok {
+			fatal("incompatible type %s for argument %d in call to %s on line %d\n", child.t, count+1, name, Line)
+		}
+		// Widen the argument if required
+		if leftOp != nil {
+			child = NewUnaryASTNode(*leftOp, param, child, 0)
+		}
+		count++
+		// Build an OpGlue AST node with the previous tree as the left child
+		// and this new expression as the right child. Store the expression count.
+		tree = NewASTNode(OpGlue, nil, tree, nil, child, count)
+		// Must have a ',' or ')' at this point
+		switch CurrentToken.token {
+		case TokenComma:
+			scan(CurrentToken)
+		case TokenRightParen:
+		default:
+			fatal("unexpected token in expression list on line %d\n", Line)
+		}
+	}
+	if count < len(ft.params) {
+		fatal("too few arguments in call to %s on line %d\n", name, Line)
+	}
+	return tree
+}
+
+// Parse a call to a function by name and return
+// its AST. The current token is the '('
+func funccall(sym *Symbol) *ASTNode {
 	// Get the '('
 	lparen()
-	// Parse the following expression
-	tree := binexpr(0)
+	// Parse the argument expression list
+	tree := expressionList(sym.t, sym.name)
 	// Build the function call AST node. Store the
 	// function's return type as this node's type.
 	// Also record the function's symbol-id
-	tree = NewUnaryASTNode(OpFunctionCall, sym.t, tree, sym.id)
+	tree = NewUnaryASTNode(OpFunctionCall, sym.t.base, tree, sym.id)
 	// Get the ')'
 	rparen()
 	return (tree)
 }
 
+// Parse a call through a pointer to a function and return
+// its AST. The pointer is the middle child of the call node.
+// The current token is the '('
+func indirectCall(callee *ASTNode) *ASTNode {
+	if !callee.t.isPointer() || callee.t.base.kind != KindFunction {
+		fatal("called object is not a function on line %d\n", Line)
+	}
+	ft := callee.t.base
+	lparen()
+	args := expressionList(ft, "function pointer")
+	rparen()
+	return NewASTNode(OpFunctionCall, ft.base, args, callee, nil, 0)
+}
+
+// Parse the index into an array or pointer and return an
+// AST tree for the element. The current token is the '['
+func arrayAccess(left *ASTNode) *ASTNode {
+	if !left.t.isPointer() {
+		fatal("not an array or pointer on line %d\n", Line)
+	}
+	// Get the '['
+	scan(CurrentToken)
+	// Parse the following expression
+	right := binexpr(0)
+	// Get the ']'
+	match(TokenRightBracket, "]")
+	// Ensure that this is of integer type
+	if !right.t.isInteger() {
+		fatal("array index is not an integer on line %d\n", Line)
+	}
+	// Return an AST tree where the array's base has the offset
+	// added to it, and dereference the element
+	left = pointerArithmetic(OpAdd, left, right)
+	return decay(NewUnaryASTNode(OpDereference, valueAt(left.t), left, 0))
+}
+
+// Parse the access to a member of a struct or union and return
+// an AST tree for it. The current token is the '.' or, if
+// withPointer is true, the '->' after the struct or union
+func memberAccess(left *ASTNode, withPointer bool) *ASTNode {
+	// Get the address of the struct or union
+	if withPointer {
+		if !left.t.isPointer() || !left.t.base.isComposite() {
+			fatal("-> must follow a pointer to a struct or union on line %d\n", Line)
+		}
+	} else {
+		if !left.t.isComposite() {
+			fatal(". must follow a struct or union on line %d\n", Line)
+		}
+		left = addressOf(left)
+	}
+	// Skip the '.' or '->' and find the member
+	scan(CurrentToken)
+	if CurrentToken.token != TokenIdent {
+		fatal("member name expected on line %d\n", Line)
+	}
+	m := left.t.base.composite.member(Text)
+	if m == nil {
+		fatal("no member named %s in %s on line %d\n", Text, left.t.base, Line)
+	}
+	scan(CurrentToken)
+	// The member's address is the struct's address
+	// plus the member's offset. Dereference it
+	right := NewLeafASTNode(OpIntLiteral, TypeLong, m.posn)
+	tree := NewASTNode(OpAdd, pointerTo(m.t), left, nil, right, 0)
+	return decay(NewUnaryASTNode(OpDereference, m.t, tree, 0))
+}
+
+// An expression whose type is an array decays to a pointer to
+// the array's first element, and a function's name decays to a
+// pointer to the function. Return the tree with this applied
+func decay(tree *ASTNode) *ASTNode {
+	switch tree.t.kind {
+	case KindArray:
+		t := pointerTo(tree.t.base)
+		tree = addressOf(tree)
+		tree.t = t
+	case KindFunction:
+		tree = addressOf(tree)
+	}
+	return tree
+}
+
+// Return an AST tree for the address of the given tree,
+// which must be a variable or a dereferenced pointer
+func addressOf(tree *ASTNode) *ASTNode {
+	t := pointerTo(tree.t)
+	switch tree.op {
+	case OpIdent:
+		tree.op = OpAddress
+	case OpDereference:
+		// The address is the pointer being dereferenced
+		tree = tree.left
+	case OpAddress:
+		// An array or function name which has already decayed.
+		// Its address is the same, but points to the whole thing
+		sym := GetSymbolByID(tree.value)
+		if sym.t.kind != KindArray && sym.t.kind != KindFunction {
+			fatal("can't take the address of this expression on line %d\n", Line)
+		}
+		t = pointerTo(sym.t)
+	default:
+		fatal("can't take the address of this expression on line %d\n", Line)
+	}
+	tree.t = t
+	return tree
+}
+
 // Parse a prefix expression and return
 // a sub-tree representing it.
 func prefix() *ASTNode {
 	switch CurrentToken.token {
 	case TokenAmpersand:
 		// Get the next token and parse it
-		// recursively as a prefix expression
+		// recursively as a prefix expression.
+		// Then get the address of what it refers to
 		scan(CurrentToken)
-		tree := prefix()
-		// Ensure that it's an identifier
-		if tree.op != OpIdent {
-			fatal("& operator must be followed by an identifier\n")
-		}
-		// Now change the operator to A_ADDR and the type to
-		// a pointer to the original type
-		tree.op = OpAddress
-		tree.t = pointerTo(tree.t)
-		return tree
+		return addressOf(prefix())
 	case TokenStar:
 		// Get the next token and parse it
 		// recursively as a prefix expression
 		scan(CurrentToken)
 		tree := prefix()
-		// For now, ensure it's either another deref or an
-		// identifier
-		if tree.op != OpIdent && tree.op != OpDereference {
-			fatal("* operator must be followed by an identifier or *\n")
+		// Ensure that it's a pointer
+		if !tree.t.isPointer() {
+			fatal("* operator must be followed by a pointer on line %d\n", Line)
 		}
 		// Prepend an OpDereference operation to the tree
-		return NewUnaryASTNode(OpDereference, valueAt(tree.t), tree, 0)
+		return decay(NewUnaryASTNode(OpDereference, valueAt(tree.t), tree, 0))
+	case TokenMinus:
+		scan(CurrentToken)
+		tree := prefix()
+		// A negative literal is just another literal
+		if tree.op == OpIntLiteral {
+			tree.value = -tree.value
+			tree.t = literalType(tree.value)
+			return tree
+		}
+		tree = promote(tree, "-")
+		return NewUnaryASTNode(OpNegate, tree.t, tree, 0)
+	case TokenInvert:
+		scan(CurrentToken)
+		tree := promote(prefix(), "~")
+		return NewUnaryASTNode(OpInvert, tree.t, tree, 0)
+	case TokenIncrement, TokenDecrement:
+		// Add or subtract one from the lvalue
+		// which follows, giving the new value
+		op := OpAdd
+		if CurrentToken.token == TokenDecrement {
+			op = OpSubtract
+		}
+		scan(CurrentToken)
+		return modify(op, prefix(), NewLeafASTNode(OpIntLiteral, TypeChar, 1))
+	case TokenLogicalNot:
+		scan(CurrentToken)
+		tree := prefix()
+		if !tree.t.isScalar() {
+			fatal("operand of ! must be an integer or pointer on line %d\n", Line)
+		}
+		return NewUnaryASTNode(OpLogicalNot, TypeInt, tree, 0)
+	}
+	return postfix()
+}
+
+// Check that the operand of a unary arithmetic operator
+// is an integer and widen it to int if it is a char
+func promote(tree *ASTNode, operator string) *ASTNode {
+	if !tree.t.isInteger() {
+		fatal("operand of %s must be an integer on line %d\n", operator, Line)
+	}
+	if tree.t.kind == KindChar {
+		tree = NewUnaryASTNode(OpWiden, TypeInt, tree, 0)
+	}
+	return tree
+}
+
+// Return the type of an integer literal with the given value.
+// Make it a P_CHAR if it's within the P_CHAR range
+func literalType(value int) *Type {
+	switch {
+	case value >= 0 && value < 256:
+		return TypeChar
+	case value >= -1<<31 && value < 1<<31:
+		return TypeInt
+	}
+	return TypeLong
+}
+
+// Parse a postfix expression: a primary expression followed by
+// any number of array indexes, member accesses and calls
+func postfix() *ASTNode {
+	tree := primary()
+	for {
+		switch CurrentToken.token {
+		case TokenLeftBracket:
+			tree = arrayAccess(tree)
+		case TokenDot:
+			tree = memberAccess(tree, false)
+		case TokenArrow:
+			tree = memberAccess(tree, true)
+		case TokenLeftParen:
+			tree = indirectCall(tree)
+		case TokenIncrement:
+			scan(CurrentToken)
+			tree = postIncrement(OpPostIncrement, tree)
+		case TokenDecrement:
+			scan(CurrentToken)
+			tree = postIncrement(OpPostDecrement, tree)
+		default:
+			return tree
+		}
 	}
-	return primary()
 }
 
 // Parse a primary factor and return an
@@ -92,27 +325,39 @@ func primary() *ASTNode {
 	// and scan in the next token. Otherwise, a syntax error
 	// for any other token type.
 	switch CurrentToken.token {
+	case TokenLeftParen:
+		// Beginning of a parenthesised expression, skip the '('.
+		// Scan in the expression and the right parenthesis
+		scan(CurrentToken)
+		node = binexpr(0)
+		rparen()
+		return node
 	case TokenIntLiteral:
-		// For an INTLIT token, make a leaf AST node for it.
-		// Make it a P_CHAR if it's within the P_CHAR range
-		if CurrentToken.value >= 0 && CurrentToken.value < 256 {
-			node = NewLeafASTNode(OpIntLiteral, NodeChar, CurrentToken.value)
-		} else {
-			node = NewLeafASTNode(OpIntLiteral, NodeInt, CurrentToken.value)
+		// For an INTLIT token, make a leaf AST node for it
+		node = NewLeafASTNode(OpIntLiteral, literalType(CurrentToken.value), CurrentToken.value)
+	case TokenStringLiteral:
+		// Adjacent string literals are joined into one.
+		// Make a leaf AST node for it, whose value is the
+		// label of the string and whose type is a char pointer
+		s := Text
+		for scan(CurrentToken); CurrentToken.token == TokenStringLiteral; scan(CurrentToken) {
+			s += Text
 		}
+		return NewLeafASTNode(OpStringLiteral, pointerTo(TypeChar), genglobstr(s))
 	case TokenIdent:
 		// This could be a variable or a function call.
 		// Scan in the next token to find out
+		sym := GetSymbolByString(Text)
 		scan(CurrentToken)
-		// It's a '(', so a function call
-		if CurrentToken.token == TokenLeftParen {
-			return funccall()
+		// It's a '(' after a function's name, so a function call
+		if CurrentToken.token == TokenLeftParen && sym.st == NodeFunction {
+			return funccall(sym)
 		}
 		// Not a function call, so reject the new token
+		// and make a leaf node for the identifier. Arrays
+		// and functions decay to pointers
 		rejectToken(CurrentToken)
-		// Continue on with normal variable parsing
-		sym := GetSymbolByString(Text)
-		node = NewLeafASTNode(OpIdent, sym.t, sym.id)
+		node = decay(NewLeafASTNode(OpIdent, sym.t, sym.id))
 	default:
 		fatal("syntax error on line %d\n", Line)
 		return nil
@@ -121,14 +366,120 @@ func primary() *ASTNode {
 	return node
 }
 
+// Return true if the token ends an expression
+func endOfExpression(t TokenType) bool {
+	switch t {
+	case TokenSemicolon, TokenRightParen, TokenRightBracket, TokenComma, TokenColon:
+		return true
+	}
+	return false
+}
+
+// The operation carried out by each compound assignment token
+var compoundAssignOps = map[TokenType]OpType{
+	TokenAssignPlus:       OpAdd,
+	TokenAssignMinus:      OpSubtract,
+	TokenAssignStar:       OpMultiply,
+	TokenAssignSlash:      OpDivide,
+	TokenAssignPercent:    OpModulo,
+	TokenAssignAmpersand:  OpAnd,
+	TokenAssignPipe:       OpOr,
+	TokenAssignCaret:      OpXor,
+	TokenAssignLeftShift:  OpLeftShift,
+	TokenAssignRightShift: OpRightShift,
+}
+
+// Check that the tree is something which can be assigned
+// to: a variable or a dereferenced pointer which isn't const
+func checkLvalue(tree *ASTNode) {
+	if tree.op != OpIdent && tree.op != OpDereference {
+		fatal("can't assign to this expression on line %d\n", Line)
+	}
+	if tree.t.isComposite() {
+		fatal("can't assign a struct or union on line %d\n", Line)
+	}
+	if tree.t.qualifiers&QualConst != 0 {
+		fatal("can't assign to a const on line %d\n", Line)
+	}
+}
+
+// Turn a variable or dereferenced pointer into
+// the lvalue which is the target of an assignment
+func lvalue(tree *ASTNode) *ASTNode {
+	checkLvalue(tree)
+	if tree.op == OpIdent {
+		tree.op = OpLvIdent
+	} else {
+		tree.op = OpLvDereference
+	}
+	return tree
+}
+
+// Build the AST tree which applies the operation to the lvalue
+// in target and the value, and stores the result back in the
+// target, as for += or ++x. Its value is the new value
+func modify(op OpType, target, value *ASTNode) *ASTNode {
+	checkLvalue(target)
+	if !value.t.isInteger() || !target.t.isInteger() && (!target.t.isPointer() || op != OpAdd && op != OpSubtract) {
+		fatal("invalid operand for compound assignment on line %d\n", Line)
+	}
+	if (op == OpDivide || op == OpModulo) && value.op == OpIntLiteral && value.value == 0 {
+		fatal("division by zero on line %d\n", Line)
+	}
+	switch {
+	case target.t.isPointer():
+		// Move the pointer in units of the type pointed to
+		if size := pointeeSize(target.t); size > 1 {
+			value = NewUnaryASTNode(OpScale, TypeLong, value, size)
+		}
+	case op != OpLeftShift && op != OpRightShift:
+		// Ensure the value is compatible with the target
+		leftOp, _, ok := typeCompatible(value.t, target.t, true)
+		if !ok {
+			fatal("incompatible types %s and %s on line %d\n", target.t, value.t, Line)
+		}
+		if leftOp != nil {
+			value = NewUnaryASTNode(*leftOp, target.t, value, 0)
+		}
+	}
+	return NewASTNode(OpCompoundAssign, target.t, target, nil, value, int(op))
+}
+
+// Build the AST tree for x++ or x--, whose value
+// is the value of the lvalue x before the change
+func postIncrement(op OpType, target *ASTNode) *ASTNode {
+	checkLvalue(target)
+	step := 1
+	if target.t.isPointer() {
+		step = pointeeSize(target.t)
+	} else if !target.t.isInteger() {
+		fatal("invalid operand for ++ or -- on line %d\n", Line)
+	}
+	return NewUnaryASTNode(op, target.t, target, step)
+}
+
 // Return an AST tree whose root is a binary operator
 func binexpr(previousTokenPrecedence int) *ASTNode {
 	// Get the integer literal on the left.
 	// Fetch the next token at the same time.
 	left := prefix()
 	tokenType := CurrentToken.token
+	// An assignment takes the rest of the expression as its
+	// value, so a = b = c assigns c to b first. Nothing but
+	// another assignment can be on an assignment's left
+	if previousTokenPrecedence == 0 {
+		if tokenType == TokenAssign {
+			scan(CurrentToken)
+			target := lvalue(left)
+			return assign(binexpr(0), target)
+		}
+		if op, ok := compoundAssignOps[tokenType]; ok {
+			scan(CurrentToken)
+			return modify(op, left, binexpr(0))
+		}
+	}
 	// If no tokens left, return just the left node
-	if tokenType == TokenSemicolon || tokenType == TokenRightParen {
+	if endOfExpression(tokenType) {
 		return left
 	}
 	// While the precedence of this token is
@@ -136,28 +487,67 @@ func binexpr(previousTokenPrecedence int) *ASTNode {
 	for OpPrecedence(tokenType) > previousTokenPrecedence {
 		// Fetch in the next integer literal
 		scan(CurrentToken)
+		if tokenType == TokenQuestion {
+			left = ternary(left)
+			tokenType = CurrentToken.token
+			if endOfExpression(tokenType) {
+				return left
+			}
+			continue
+		}
 		// Recursively call binexpr() with the
 		// precedence of our token to build a sub-tree
 		right := binexpr(OperatorPrecedence[tokenType])
-		// Ensure the two types are compatible.
-		leftOp, rightOp, ok := typeCompatible(left.t, right.t, false)
-		if !ok {
-			fatal("incompatible types\n")
-		}
-		// Widen either side if required. type vars are A_WIDEN now
-		if leftOp != nil {
-			left = NewUnaryASTNode(*leftOp, right.t, left, 0)
-		}
-		if rightOp != nil {
-			right = NewUnaryASTNode(*rightOp, left.t, right, 0)
+		// Convert the token into an AST operation
+		op := arithop(tokenType)
+		if op == OpLogicalAnd || op == OpLogicalOr {
+			// Each side is only compared against zero,
+			// so no widening is needed
+			if !left.t.isScalar() || !right.t.isScalar() {
+				fatal("operands of && and || must be integers or pointers on line %d\n", Line)
+			}
+			left = NewASTNode(op, TypeInt, left, nil, right, 0)
+		} else if op == OpLeftShift || op == OpRightShift {
+			// The result has the type of the left side,
+			// whatever the type of the shift count
+			left = promote(left, "a shift")
+			if !right.t.isInteger() {
+				fatal("shift count must be an integer on line %d\n", Line)
+			}
+			left = NewASTNode(op, left.t, left, nil, right, 0)
+		} else if (op == OpAdd || op == OpSubtract) && (left.t.isPointer() || right.t.isPointer()) {
+			// Pointer arithmetic works in units of the type pointed to
+			left = pointerArithmetic(op, left, right)
+		} else {
+			// Only integers can be multiplied, divided or used bitwise
+			switch op {
+			case OpMultiply, OpDivide, OpModulo, OpAnd, OpOr, OpXor:
+				if !left.t.isInteger() || !right.t.isInteger() {
+					fatal("invalid pointer operand on line %d\n", Line)
+				}
+			}
+			if (op == OpDivide || op == OpModulo) && right.op == OpIntLiteral && right.value == 0 {
+				fatal("division by zero on line %d\n", Line)
+			}
+			// Ensure the two types are compatible.
+			leftOp, rightOp, ok := typeCompatible(left.t, right.t, false)
+			if !ok {
+				fatal("incompatible types %s and %s on line %d\n", left.t, right.t, Line)
+			}
+			// Widen either side if required. type vars are A_WIDEN now
+			if leftOp != nil {
+				left = NewUnaryASTNode(*leftOp, right.t, left, 0)
+			}
+			if rightOp != nil {
+				right = NewUnaryASTNode(*rightOp, left.t, right, 0)
+			}
+			// Join that sub-tree with ours
+			left = NewASTNode(op, left.t, left, nil, right, 0)
 		}
-		// Join that sub-tree with ours. Convert the token
-		// into an AST operation at the same time.
-		left = NewASTNode(arithop(tokenType), left.t, left, nil, right, 0)
 		// Update the details of the current token.
 		tokenType = CurrentToken.token
 		// If no tokens left, return just the left node
-		if tokenType == TokenSemicolon || tokenType == TokenRightParen {
+		if endOfExpression(tokenType) {
 			return left
 		}
 	}
@@ -166,6 +556,122 @@ func binexpr(previousTokenPrecedence int) *ASTNode {
 	return left
 }
 
+// Parse the rest of a ternary expression, given its
+// condition, once the '?' has been scanned. The false
+// arm can itself be a ternary, so a ? b : c ? d : e
+// chooses between b and the ternary c ? d : e
+func ternary(cond *ASTNode) *ASTNode {
+	if !cond.t.isScalar() {
+		fatal("condition of ?: must be an integer or pointer on line %d\n", Line)
+	}
+	// Any expression can go between the '?' and the ':'
+	trueArm := binexpr(0)
+	match(TokenColon, ":")
+	falseArm := binexpr(OperatorPrecedence[TokenQuestion] - 1)
+	// Widen either arm so that both have the same type
+	trueOp, falseOp, ok := typeCompatible(trueArm.t, falseArm.t, false)
+	if !ok {
+		fatal("incompatible types %s and %s in ?: on line %d\n", trueArm.t, falseArm.t, Line)
+	}
+	if trueOp != nil {
+		trueArm = NewUnaryASTNode(*trueOp, falseArm.t, trueArm, 0)
+	}
+	if falseOp != nil {
+		falseArm = NewUnaryASTNode(*falseOp, trueArm.t, falseArm, 0)
+	}
+	return NewASTNode(OpTernary, trueArm.t, cond, trueArm, falseArm, 0)
+}
+
+// Work out the value of an expression made only of
+// integer literals. Return false if it isn't constant
+func constantValue(tree *ASTNode) (int, bool) {
+	switch tree.op {
+	case OpIntLiteral:
+		return tree.value, true
+	case OpWiden:
+		return constantValue(tree.left)
+	case OpNegate, OpInvert, OpLogicalNot:
+		value, ok := constantValue(tree.left)
+		switch tree.op {
+		case OpNegate:
+			value = -value
+		case OpInvert:
+			value = ^value
+		default:
+			value = boolValue(value == 0)
+		}
+		return value, ok
+	case OpTernary:
+		cond, ok := constantValue(tree.left)
+		if !ok {
+			return 0, false
+		}
+		if cond != 0 {
+			return constantValue(tree.middle)
+		}
+		return constantValue(tree.right)
+	}
+	if tree.left == nil || tree.right == nil {
+		return 0, false
+	}
+	left, leftOk := constantValue(tree.left)
+	right, rightOk := constantValue(tree.right)
+	if !leftOk || !rightOk {
+		return 0, false
+	}
+	// Dividing by zero has no value, so it isn't a constant
+	if (tree.op == OpDivide || tree.op == OpModulo) && right == 0 {
+		return 0, false
+	}
+	switch tree.op {
+	case OpAdd:
+		return left + right, true
+	case OpSubtract:
+		return left - right, true
+	case OpMultiply:
+		return left * right, true
+	case OpDivide:
+		return left / right, true
+	case OpModulo:
+		return left % right, true
+	case OpAnd:
+		return left & right, true
+	case OpOr:
+		return left | right, true
+	case OpXor:
+		return left ^ right, true
+	case OpLeftShift:
+		return left << uint(right), true
+	case OpRightShift:
+		return left >> uint(right), true
+	case OpEqual:
+		return boolValue(left == right), true
+	case OpNotEqual:
+		return boolValue(left != right), true
+	case OpLessThan:
+		return boolValue(left < right), true
+	case OpGreaterThan:
+		return boolValue(left > right), true
+	case OpLessThanOrEqual:
+		return boolValue(left <= right), true
+	case OpGreaterThanOrEqual:
+		return boolValue(left >= right), true
+	case OpLogicalAnd:
+		return boolValue(left != 0 && right != 0), true
+	case OpLogicalOr:
+		return boolValue(left != 0 || right != 0), true
+	}
+	return 0, false
+}
+
+// Return 1 for true and 0 for false
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 // Convert a token into an AST operation.
 func arithop(t TokenType) OpType {
 	switch t {
@@ -177,6 +683,8 @@ func arithop(t TokenType) OpType {
 		return OpMultiply
 	case TokenSlash:
 		return OpDivide
+	case TokenPercent:
+		return OpModulo
 	case TokenEqual:
 		return OpEqual
 	case TokenNotEqual:
@@ -189,6 +697,20 @@ func arithop(t TokenType) OpType {
 		return OpGreaterThan
 	case TokenGreaterThanOrEqual:
 		return OpGreaterThanOrEqual
+	case TokenAnd:
+		return OpLogicalAnd
+	case TokenOr:
+		return OpLogicalOr
+	case TokenAmpersand:
+		return OpAnd
+	case TokenPipe:
+		return OpOr
+	case TokenCaret:
+		return OpXor
+	case TokenLeftShift:
+		return OpLeftShift
+	case TokenRightShift:
+		return OpRightShift
 	default:
 		fatal("unknown token in arithop() on line %d\n", Line)
 		return 0
@@ -0,0 +1,1055 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The directories given with -I, searched
+// in order for files to #include
+var IncludeDirs []string
+
+// Included files can't nest deeper than this
+const MaxIncludeDepth = 200
+
+// ppKind
+type ppKind int
+
+// Kinds of preprocessing token
+const (
+	ppSpace       ppKind = iota // Whitespace
+	ppComment                   // A comment, including its markers
+	ppIdent                     // x
+	ppNumber                    // 12
+	ppString                    // A string or character literal
+	ppPunct                     // Any other character or operator
+	ppPaste                     // A ## in a macro body
+	ppStringify                 // A # before a parameter in a macro body
+	ppPlacemarker               // An empty argument next to a ##
+)
+
+// A preprocessing token. The hide set holds the macros
+// whose expansion produced the token, which can't be
+// expanded again inside themselves
+type ppToken struct {
+	kind ppKind
+	text string
+	hide map[string]bool
+}
+
+// A macro made by #define
+type macro struct {
+	name     string
+	function bool     // True if the macro takes arguments
+	params   []string // For function-like macros, the parameter names
+	variadic bool     // True if the last parameter is __VA_ARGS__
+	body     []ppToken
+}
+
+// The macros defined so far, by name
+var macros = make(map[string]*macro)
+
+// A conditional is an #if, #ifdef or #ifndef
+// with its #elif and #else branches
+type conditional struct {
+	line    int  // The line of the #if
+	parent  bool // True if the lines around the #if are kept
+	active  bool // True if the lines in the current branch are kept
+	taken   bool // True once a branch has been kept
+	sawElse bool
+}
+
+// A file being preprocessed
+type ppFile struct {
+	name      string
+	lines     []string
+	pos       int  // The index of the next line to read
+	line      int  // The number of the next line to read
+	inComment bool // True if the next line starts inside a comment
+	conds     []conditional
+	out       *strings.Builder
+}
+
+// The punctuators which are longer than one character,
+// longest first so that the longest match is found
+var ppPuncts = []string{
+	"...", "<<=", ">>=", "##", "->", "++", "--", "<<", ">>", "<=", ">=",
+	"==", "!=", "&&", "||", "+=", "-=", "*=", "/=", "%=", "&=", "^=", "|=",
+}
+
+// Preprocess the named file and return the text for the
+// scanner. Line markers in the text keep the scanner's
+// Line and Filename accurate to the original files
+func preprocess(name string) string {
+	var out strings.Builder
+	ppinclude(&out, name, 0)
+	return out.String()
+}
+
+// Preprocess an included file, or the main file at depth 0,
+// and write the result after a line marker for its first line
+func ppinclude(out *strings.Builder, name string, depth int) {
+	if depth > MaxIncludeDepth {
+		fatal("#include nested too deeply in %s\n", name)
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		fatal("unable to open file %s: %v\n", name, err)
+	}
+	f := &ppFile{name: name, lines: strings.Split(string(data), "\n"), line: 1, out: out}
+	// A file ending in a newline has no last line after it
+	if n := len(f.lines); f.lines[n-1] == "" {
+		f.lines = f.lines[:n-1]
+	}
+	Filename = name
+	f.marker()
+	for {
+		text, n, ok := f.readLine()
+		if !ok {
+			break
+		}
+		line := f.line - n
+		startInComment := f.inComment
+		tokens := pptokenize(text, &f.inComment)
+		if !startInComment && isDirective(tokens) {
+			// A comment at the end of a directive can run onto later lines
+			for f.inComment {
+				more, m, ok := f.readLine()
+				if !ok {
+					fatal("unterminated comment starting on line %d\n", line)
+				}
+				tokens = append(tokens, pptokenize(more, &f.inComment)...)
+				n += m
+			}
+			if f.directive(tokens, line, depth) {
+				// The directive wrote a line marker for what follows
+				continue
+			}
+			f.out.WriteString(strings.Repeat("\n", n))
+			continue
+		}
+		if !f.active() {
+			f.out.WriteString(strings.Repeat("\n", n))
+			continue
+		}
+		// Expand the macros. A macro's arguments can carry on
+		// over the following lines, so let expand() read them
+		more := func() []ppToken {
+			if f.pos == len(f.lines) || f.inComment || strings.HasPrefix(strings.TrimSpace(f.lines[f.pos]), "#") {
+				return nil
+			}
+			text, m, _ := f.readLine()
+			n += m
+			return append([]ppToken{{kind: ppSpace, text: " "}}, pptokenize(text, &f.inComment)...)
+		}
+		f.out.WriteString(ppjoin(expand(tokens, line, more)))
+		f.out.WriteString(strings.Repeat("\n", n))
+	}
+	if len(f.conds) > 0 {
+		fatal("unterminated #if starting on line %d\n", f.conds[len(f.conds)-1].line)
+	}
+}
+
+// Write a line marker giving the number
+// and file name of the next line
+func (f *ppFile) marker() {
+	fmt.Fprintf(f.out, "#line %d %q\n", f.line, f.name)
+}
+
+// Read the next line, joining lines which end in a '\'
+// onto the next. Return it and the number of lines read,
+// or false at the end of the file
+func (f *ppFile) readLine() (string, int, bool) {
+	if f.pos == len(f.lines) {
+		return "", 0, false
+	}
+	var b strings.Builder
+	n := 0
+	for f.pos < len(f.lines) {
+		s := strings.TrimSuffix(f.lines[f.pos], "\r")
+		f.pos++
+		f.line++
+		n++
+		if !strings.HasSuffix(s, "\\") {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:len(s)-1])
+	}
+	return b.String(), n, true
+}
+
+// Return true if the lines in the current
+// branch of all the conditionals are kept
+func (f *ppFile) active() bool {
+	return len(f.conds) == 0 || f.conds[len(f.conds)-1].active
+}
+
+// Return true if the tokens of a line, ignoring
+// whitespace and comments, begin with a '#'
+func isDirective(tokens []ppToken) bool {
+	tokens = trimSpace(tokens)
+	return len(tokens) > 0 && tokens[0].kind == ppPunct && tokens[0].text == "#"
+}
+
+// Carry out the directive on the given line. Return true
+// if a line marker has been written for the following line
+func (f *ppFile) directive(tokens []ppToken, line, depth int) bool {
+	// Comments in a directive are just whitespace
+	for i := range tokens {
+		if tokens[i].kind == ppComment {
+			tokens[i] = ppToken{kind: ppSpace, text: " "}
+		}
+	}
+	// Skip the '#' and get the directive's name.
+	// A '#' on its own does nothing
+	tokens = trimSpace(trimSpace(tokens)[1:])
+	if len(tokens) == 0 {
+		return false
+	}
+	name := tokens[0].text
+	args := trimSpace(tokens[1:])
+	// The conditionals are followed even in lines which
+	// aren't kept, so that they can be matched up
+	switch name {
+	case "if", "ifdef", "ifndef":
+		c := conditional{line: line, parent: f.active()}
+		if c.parent {
+			switch name {
+			case "if":
+				c.active = ppeval(args, line)
+			case "ifdef":
+				c.active = macros[ppname(args, name, line)] != nil
+			case "ifndef":
+				c.active = macros[ppname(args, name, line)] == nil
+			}
+		}
+		c.taken = c.active
+		f.conds = append(f.conds, c)
+		return false
+	case "elif", "else":
+		if len(f.conds) == 0 {
+			fatal("#%s without #if on line %d\n", name, line)
+		}
+		c := &f.conds[len(f.conds)-1]
+		if c.sawElse {
+			fatal("#%s after #else on line %d\n", name, line)
+		}
+		if name == "else" {
+			c.sawElse = true
+			c.active = c.parent && !c.taken
+		} else {
+			c.active = c.parent && !c.taken && ppeval(args, line)
+		}
+		c.taken = c.taken || c.active
+		return false
+	case "endif":
+		if len(f.conds) == 0 {
+			fatal("#endif without #if on line %d\n", line)
+		}
+		f.conds = f.conds[:len(f.conds)-1]
+		return false
+	}
+	if !f.active() {
+		return false
+	}
+	switch name {
+	case "define":
+		ppdefine(args, line)
+	case "undef":
+		delete(macros, ppname(args, name, line))
+	case "include":
+		path := f.includePath(args, line)
+		ppinclude(f.out, path, depth+1)
+		// Carry on with this file after the #include
+		Filename = f.name
+		f.marker()
+		return true
+	case "line":
+		// The line number and file name can come from macros
+		args = trimSpace(expand(args, line, nil))
+		var words []ppToken
+		for _, t := range args {
+			if t.kind != ppSpace {
+				words = append(words, t)
+			}
+		}
+		if len(words) == 0 || len(words) > 2 || words[0].kind != ppNumber {
+			fatal("#line needs a line number and an optional file name on line %d\n", line)
+		}
+		n, err := strconv.Atoi(words[0].text)
+		if err != nil || n <= 0 {
+			fatal("bad line number %s in #line on line %d\n", words[0].text, line)
+		}
+		if len(words) == 2 {
+			if words[1].kind != ppString || words[1].text[0] != '"' {
+				fatal("bad file name in #line on line %d\n", line)
+			}
+			ppterminated(words[1], line)
+			f.name = ppunquote(words[1].text)
+			Filename = f.name
+		}
+		f.line = n
+		f.marker()
+		return true
+	case "error":
+		fatal("#error %s on line %d\n", ppjoin(args), line)
+	case "warning":
+		warning("#warning %s on line %d\n", ppjoin(args), line)
+	case "pragma":
+		// No pragmas are supported, so they are ignored
+	default:
+		fatal("unknown directive #%s on line %d\n", name, line)
+	}
+	return false
+}
+
+// Return the name of the macro which is the only
+// argument of the given directive
+func ppname(args []ppToken, directive string, line int) string {
+	if len(args) != 1 || args[0].kind != ppIdent {
+		fatal("#%s needs a macro name on line %d\n", directive, line)
+	}
+	return args[0].text
+}
+
+// Find the file named by an #include. A "file" is looked
+// for next to the including file and then in the -I
+// directories. A <file> is only looked for in the latter
+func (f *ppFile) includePath(args []ppToken, line int) string {
+	// The name can come from macros
+	if len(args) > 0 && args[0].kind != ppString && args[0].text != "<" {
+		args = trimSpace(expand(args, line, nil))
+	}
+	var name string
+	dirs := IncludeDirs
+	switch {
+	case len(args) == 1 && args[0].kind == ppString && args[0].text[0] == '"':
+		ppterminated(args[0], line)
+		name = ppunquote(args[0].text)
+		dirs = append([]string{filepath.Dir(f.name)}, dirs...)
+	case len(args) > 2 && args[0].text == "<" && args[len(args)-1].text == ">":
+		name = ppjoin(args[1 : len(args)-1])
+	default:
+		fatal("#include needs \"file\" or <file> on line %d\n", line)
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	fatal("can't find include file %s on line %d\n", name, line)
+	return ""
+}
+
+// Parse the rest of a #define and add the macro
+func ppdefine(args []ppToken, line int) {
+	if len(args) == 0 || args[0].kind != ppIdent {
+		fatal("#define needs a macro name on line %d\n", line)
+	}
+	m := &macro{name: args[0].text}
+	if m.name == "defined" {
+		fatal("can't define \"defined\" on line %d\n", line)
+	}
+	args = args[1:]
+	// A '(' straight after the name starts a parameter list
+	if len(args) > 0 && args[0].text == "(" {
+		m.function = true
+		args = trimSpace(args[1:])
+		for len(args) > 0 && args[0].text != ")" {
+			switch {
+			case args[0].text == "...":
+				m.variadic = true
+				m.params = append(m.params, "__VA_ARGS__")
+			case args[0].kind == ppIdent:
+				if m.param(args[0].text) >= 0 {
+					fatal("duplicate macro parameter %s on line %d\n", args[0].text, line)
+				}
+				m.params = append(m.params, args[0].text)
+			default:
+				fatal("bad macro parameter %s on line %d\n", args[0].text, line)
+			}
+			// Must have a ',' or ')' at this point
+			args = trimSpace(args[1:])
+			if len(args) > 0 && args[0].text == "," && !m.variadic {
+				args = trimSpace(args[1:])
+			} else if len(args) == 0 || args[0].text != ")" {
+				fatal("missing ) in parameter list of %s on line %d\n", m.name, line)
+			}
+		}
+		if len(args) == 0 {
+			fatal("missing ) in parameter list of %s on line %d\n", m.name, line)
+		}
+		args = args[1:]
+	}
+	// Mark the # and ## operators in the body
+	m.body = trimSpace(args)
+	for i, t := range m.body {
+		if t.kind != ppPunct {
+			continue
+		}
+		if t.text == "##" {
+			if i == 0 || i == len(m.body)-1 {
+				fatal("## can't be at either end of a macro on line %d\n", line)
+			}
+			m.body[i].kind = ppPaste
+		} else if t.text == "#" && m.function {
+			next := trimSpace(m.body[i+1:])
+			if len(next) == 0 || next[0].kind != ppIdent || m.param(next[0].text) < 0 {
+				fatal("# is not followed by a macro parameter on line %d\n", line)
+			}
+			m.body[i].kind = ppStringify
+		}
+	}
+	// Defining a macro again is only a problem if it changes
+	if old := macros[m.name]; old != nil && ppjoin(normalSpace(old.body)) != ppjoin(normalSpace(m.body)) {
+		warning("%s redefined on line %d\n", m.name, line)
+	}
+	macros[m.name] = m
+}
+
+// Return the position of the named parameter
+// of a macro, or -1 if it isn't one
+func (m *macro) param(name string) int {
+	for i, p := range m.params {
+		if p == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Expand the macros in the tokens on the given line. more is
+// called to get the tokens on the next line when a macro's
+// arguments run off the end, and can be nil
+func expand(tokens []ppToken, line int, more func() []ppToken) []ppToken {
+	var out []ppToken
+	for len(tokens) > 0 {
+		t := tokens[0]
+		if t.kind != ppIdent || t.hide[t.text] {
+			out = append(out, t)
+			tokens = tokens[1:]
+			continue
+		}
+		switch t.text {
+		case "__LINE__":
+			out = append(out, ppToken{kind: ppNumber, text: strconv.Itoa(line), hide: t.hide})
+			tokens = tokens[1:]
+			continue
+		case "__FILE__":
+			out = append(out, ppToken{kind: ppString, text: ppquote(Filename), hide: t.hide})
+			tokens = tokens[1:]
+			continue
+		}
+		m := macros[t.text]
+		if m == nil {
+			out = append(out, t)
+			tokens = tokens[1:]
+			continue
+		}
+		hide := map[string]bool{m.name: true}
+		for name := range t.hide {
+			hide[name] = true
+		}
+		if !m.function {
+			// Replace the name with the body and rescan it
+			tokens = append(subst(m, nil, hide, line), tokens[1:]...)
+			continue
+		}
+		// A function-like macro's name must be followed by a '('.
+		// If it isn't, the name is left alone
+		i := 1
+		for {
+			for i < len(tokens) && (tokens[i].kind == ppSpace || tokens[i].kind == ppComment) {
+				i++
+			}
+			if i < len(tokens) || more == nil {
+				break
+			}
+			next := more()
+			if next == nil {
+				break
+			}
+			tokens = append(tokens, next...)
+		}
+		if i == len(tokens) || tokens[i].text != "(" {
+			out = append(out, t)
+			tokens = tokens[1:]
+			continue
+		}
+		args, rest := macroArgs(m, tokens, i+1, line, more)
+		tokens = append(subst(m, args, hide, line), rest...)
+	}
+	return out
+}
+
+// Collect the arguments of a call to a function-like macro,
+// starting after the '(' at position i. Get more lines if
+// the ')' is missing. Return the arguments and the tokens
+// after the ')'
+func macroArgs(m *macro, tokens []ppToken, i, line int, more func() []ppToken) ([][]ppToken, []ppToken) {
+	var args [][]ppToken
+	var arg []ppToken
+	depth := 0
+	for {
+		if i == len(tokens) {
+			var next []ppToken
+			if more != nil {
+				next = more()
+			}
+			if next == nil {
+				fatal("unterminated call to macro %s on line %d\n", m.name, line)
+			}
+			tokens = append(tokens, next...)
+		}
+		t := tokens[i]
+		i++
+		switch {
+		case t.text == "(" && t.kind == ppPunct:
+			depth++
+		case t.text == ")" && t.kind == ppPunct:
+			if depth == 0 {
+				args = append(args, trimSpace(arg))
+				// A call with no arguments has one empty argument
+				if len(m.params) == 0 && len(args) == 1 && len(args[0]) == 0 {
+					args = nil
+				}
+				if m.variadic && len(args) == len(m.params)-1 {
+					args = append(args, nil)
+				}
+				if len(args) != len(m.params) {
+					fatal("macro %s needs %d arguments, but %d given on line %d\n", m.name, len(m.params), len(args), line)
+				}
+				return args, tokens[i:]
+			}
+			depth--
+		case t.text == "," && t.kind == ppPunct && depth == 0:
+			// The variable arguments include their commas
+			if !m.variadic || len(args) < len(m.params)-1 {
+				args = append(args, trimSpace(arg))
+				arg = nil
+				continue
+			}
+		}
+		arg = append(arg, t)
+	}
+}
+
+// Return the body of a macro with the arguments put in
+// place of the parameters and the # and ## operators
+// carried out. Every token gets the given hide set
+func subst(m *macro, args [][]ppToken, hide map[string]bool, line int) []ppToken {
+	var out []ppToken
+	for i := 0; i < len(m.body); i++ {
+		t := m.body[i]
+		if t.kind == ppStringify {
+			// Skip to the parameter and stringify its argument
+			for m.body[i].kind != ppIdent {
+				i++
+			}
+			arg := args[m.param(m.body[i].text)]
+			out = append(out, ppToken{kind: ppString, text: ppquote(ppjoin(normalSpace(arg)))})
+			continue
+		}
+		p := -1
+		if t.kind == ppIdent {
+			p = m.param(t.text)
+		}
+		if p < 0 {
+			out = append(out, t)
+			continue
+		}
+		// An argument next to a ## is used as it is,
+		// otherwise its macros are expanded first
+		if nextTo(m.body, i, ppPaste) {
+			if len(args[p]) == 0 {
+				out = append(out, ppToken{kind: ppPlacemarker})
+			}
+			out = append(out, args[p]...)
+		} else {
+			out = append(out, expand(append([]ppToken{}, args[p]...), line, nil)...)
+		}
+	}
+	out = paste(out, line)
+	for i := range out {
+		h := hide
+		if len(out[i].hide) > 0 {
+			h = make(map[string]bool)
+			for name := range hide {
+				h[name] = true
+			}
+			for name := range out[i].hide {
+				h[name] = true
+			}
+		}
+		out[i].hide = h
+	}
+	return out
+}
+
+// Return true if the token at position i in the body
+// is next to one of the given kind, ignoring whitespace
+func nextTo(body []ppToken, i int, kind ppKind) bool {
+	for j := i - 1; j >= 0; j-- {
+		if body[j].kind != ppSpace {
+			if body[j].kind == kind {
+				return true
+			}
+			break
+		}
+	}
+	for j := i + 1; j < len(body); j++ {
+		if body[j].kind != ppSpace {
+			return body[j].kind == kind
+		}
+	}
+	return false
+}
+
+// Carry out the ## operators, joining the tokens
+// either side of each into a single token
+func paste(tokens []ppToken, line int) []ppToken {
+	var out []ppToken
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].kind != ppPaste {
+			out = append(out, tokens[i])
+			continue
+		}
+		// Join the last token so far and the next one
+		out = trimSpace(out)
+		left := out[len(out)-1]
+		i++
+		for tokens[i].kind == ppSpace {
+			i++
+		}
+		right := tokens[i]
+		text := left.text + right.text
+		var joined []ppToken
+		if text == "" {
+			joined = []ppToken{{kind: ppPlacemarker}}
+		} else {
+			inComment := false
+			joined = pptokenize(text, &inComment)
+			if len(joined) != 1 {
+				fatal("pasting %s and %s does not give a valid token on line %d\n", left.text, right.text, line)
+			}
+		}
+		out = append(out[:len(out)-1], joined...)
+	}
+	// Placemarkers have done their job
+	var result []ppToken
+	for _, t := range out {
+		if t.kind != ppPlacemarker {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// Split a line into preprocessing tokens. inComment says
+// if the line starts inside a comment, and is updated to
+// say if the next line does
+func pptokenize(s string, inComment *bool) []ppToken {
+	var tokens []ppToken
+	i := 0
+	for i < len(s) {
+		start := i
+		kind := ppPunct
+		c := s[i]
+		switch {
+		case *inComment || strings.HasPrefix(s[i:], "/*"):
+			// Find the end of the comment, if it's on this line
+			kind = ppComment
+			from := i
+			if !*inComment {
+				from += 2
+			}
+			if end := strings.Index(s[from:], "*/"); end >= 0 {
+				i = from + end + 2
+				*inComment = false
+			} else {
+				i = len(s)
+				*inComment = true
+			}
+		case strings.HasPrefix(s[i:], "//"):
+			kind = ppComment
+			i = len(s)
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			kind = ppSpace
+			for i < len(s) && strings.IndexByte(" \t\r\f\v", s[i]) >= 0 {
+				i++
+			}
+		case c == '_' || unicode.IsLetter(rune(c)) || c >= 0x80:
+			kind = ppIdent
+			for i < len(s) && (s[i] == '_' || s[i] >= 0x80 || unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+		case unicode.IsDigit(rune(c)) || c == '.' && i+1 < len(s) && unicode.IsDigit(rune(s[i+1])):
+			// A number runs on through letters and digits
+			kind = ppNumber
+			for i < len(s) && (s[i] == '_' || s[i] == '.' || unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+		case c == '"' || c == '\'':
+			// Find the closing quote, skipping escaped characters.
+			// The scanner complains if there isn't one
+			kind = ppString
+			for i++; i < len(s) && s[i] != c; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+			if i < len(s) {
+				i++
+			} else {
+				i = len(s)
+			}
+		default:
+			i++
+			for _, p := range ppPuncts {
+				if strings.HasPrefix(s[start:], p) {
+					i = start + len(p)
+					break
+				}
+			}
+		}
+		tokens = append(tokens, ppToken{kind: kind, text: s[start:i]})
+	}
+	return tokens
+}
+
+// Join tokens back into text. A space goes between two tokens
+// from different places which would otherwise run together
+func ppjoin(tokens []ppToken) string {
+	var b strings.Builder
+	var prev ppToken
+	for i, t := range tokens {
+		if i > 0 && t.kind != ppSpace && prev.kind != ppSpace && (len(t.hide) > 0) != (len(prev.hide) > 0) {
+			word := func(k ppKind) bool { return k == ppIdent || k == ppNumber }
+			if word(t.kind) && word(prev.kind) || t.kind == ppPunct && prev.kind == ppPunct {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(t.text)
+		prev = t
+	}
+	return b.String()
+}
+
+// Remove the whitespace and comments from each end of the tokens
+func trimSpace(tokens []ppToken) []ppToken {
+	blank := func(t ppToken) bool { return t.kind == ppSpace || t.kind == ppComment }
+	for len(tokens) > 0 && blank(tokens[0]) {
+		tokens = tokens[1:]
+	}
+	for len(tokens) > 0 && blank(tokens[len(tokens)-1]) {
+		tokens = tokens[:len(tokens)-1]
+	}
+	return tokens
+}
+
+// Return the tokens without the whitespace at each end and
+// with each run of whitespace inside them made a single space
+func normalSpace(tokens []ppToken) []ppToken {
+	var out []ppToken
+	for _, t := range trimSpace(tokens) {
+		if t.kind == ppSpace || t.kind == ppComment {
+			if out[len(out)-1].kind != ppSpace {
+				out = append(out, ppToken{kind: ppSpace, text: " "})
+			}
+			continue
+		}
+		out = append(out, t)
+	}
+	return out
+}
+
+// Return s as a string literal
+func ppquote(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(s) + "\""
+}
+
+// Check that a string or character literal has its
+// closing quote, which it doesn't if the line ended
+// first. The scanner finds these in the program, but
+// not in the directives that the preprocessor reads
+func ppterminated(t ppToken, line int) {
+	s := t.text
+	closed := len(s) >= 2 && s[len(s)-1] == s[0]
+	if closed {
+		// The closing quote mustn't be escaped
+		n := 0
+		for i := len(s) - 2; i > 0 && s[i] == '\\'; i-- {
+			n++
+		}
+		closed = n%2 == 0
+	}
+	if !closed {
+		fatal("missing closing quote in %s on line %d\n", s, line)
+	}
+}
+
+// Return the contents of a string literal with
+// its '\'s and quotes taken out again
+func ppunquote(s string) string {
+	return strings.NewReplacer("\\\\", "\\", "\\\"", "\"").Replace(s[1 : len(s)-1])
+}
+
+// Evaluate the constant expression of an #if or #elif
+// on the given line and return true if it isn't zero
+func ppeval(tokens []ppToken, line int) bool {
+	// Replace each 'defined name' and 'defined(name)' with 1 or 0
+	// before the macros are expanded, so the names are left alone
+	var in []ppToken
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i].text != "defined" {
+			in = append(in, tokens[i])
+			continue
+		}
+		// Get the name, or the '(', name and ')'
+		var words []ppToken
+		for i+1 < len(tokens) && len(words) < 3 {
+			i++
+			if tokens[i].kind != ppSpace {
+				words = append(words, tokens[i])
+			}
+			if len(words) == 1 && words[0].text != "(" {
+				break
+			}
+		}
+		if len(words) == 3 && words[0].text == "(" && words[2].text == ")" {
+			words = words[1:2]
+		}
+		if len(words) != 1 || words[0].kind != ppIdent {
+			fatal("defined needs a macro name on line %d\n", line)
+		}
+		value := "0"
+		if macros[words[0].text] != nil {
+			value = "1"
+		}
+		in = append(in, ppToken{kind: ppNumber, text: value})
+	}
+	e := &ppExpr{line: line}
+	for _, t := range expand(in, line, nil) {
+		if t.kind != ppSpace && t.kind != ppComment {
+			e.tokens = append(e.tokens, t)
+		}
+	}
+	if len(e.tokens) == 0 {
+		fatal("#if with no expression on line %d\n", line)
+	}
+	value := e.ternary()
+	if e.pos != len(e.tokens) {
+		fatal("unexpected %s in #if on line %d\n", e.tokens[e.pos].text, line)
+	}
+	return value != 0
+}
+
+// The state of the evaluation of an #if expression
+type ppExpr struct {
+	tokens []ppToken
+	pos    int
+	line   int
+	skip   int // Above zero in the parts which aren't evaluated, e.g. after 0 &&
+}
+
+// The precedence of each binary operator in an #if
+var ppPrecedence = map[string]int{
+	"||": 1, "&&": 2, "|": 3, "^": 4, "&": 5,
+	"==": 6, "!=": 6, "<": 7, ">": 7, "<=": 7, ">=": 7,
+	"<<": 8, ">>": 8, "+": 9, "-": 9, "*": 10, "/": 10, "%": 10,
+}
+
+// Return the text of the next token, or "" at the end
+func (e *ppExpr) peek() string {
+	if e.pos == len(e.tokens) {
+		return ""
+	}
+	return e.tokens[e.pos].text
+}
+
+// Skip a token which must be there
+func (e *ppExpr) expect(s string) {
+	if e.peek() != s {
+		fatal("%s expected in #if on line %d\n", s, e.line)
+	}
+	e.pos++
+}
+
+// Evaluate a ternary expression
+func (e *ppExpr) ternary() int64 {
+	cond := e.binary(0)
+	if e.peek() != "?" {
+		return cond
+	}
+	e.pos++
+	// Only one of the two choices is evaluated
+	if cond == 0 {
+		e.skip++
+	}
+	left := e.ternary()
+	if cond == 0 {
+		e.skip--
+	}
+	e.expect(":")
+	if cond != 0 {
+		e.skip++
+	}
+	right := e.ternary()
+	if cond != 0 {
+		e.skip--
+		return left
+	}
+	return right
+}
+
+// Evaluate the binary operators whose precedence
+// is more than the given precedence
+func (e *ppExpr) binary(prec int) int64 {
+	left := e.unary()
+	for {
+		op := e.peek()
+		p := ppPrecedence[op]
+		if p <= prec {
+			return left
+		}
+		e.pos++
+		// The right side of && and || may not be evaluated
+		short := op == "&&" && left == 0 || op == "||" && left != 0
+		if short {
+			e.skip++
+		}
+		right := e.binary(p)
+		if short {
+			e.skip--
+		}
+		left = e.apply(op, left, right)
+	}
+}
+
+// Apply a binary operator to two values
+func (e *ppExpr) apply(op string, left, right int64) int64 {
+	b := func(v bool) int64 {
+		if v {
+			return 1
+		}
+		return 0
+	}
+	switch op {
+	case "||":
+		return b(left != 0 || right != 0)
+	case "&&":
+		return b(left != 0 && right != 0)
+	case "|":
+		return left | right
+	case "^":
+		return left ^ right
+	case "&":
+		return left & right
+	case "==":
+		return b(left == right)
+	case "!=":
+		return b(left != right)
+	case "<":
+		return b(left < right)
+	case ">":
+		return b(left > right)
+	case "<=":
+		return b(left <= right)
+	case ">=":
+		return b(left >= right)
+	case "<<":
+		return left << uint64(right&63)
+	case ">>":
+		return left >> uint64(right&63)
+	case "+":
+		return left + right
+	case "-":
+		return left - right
+	case "*":
+		return left * right
+	}
+	// Division by zero only matters if it is evaluated
+	if right == 0 {
+		if e.skip == 0 {
+			fatal("division by zero in #if on line %d\n", e.line)
+		}
+		return 0
+	}
+	if op == "/" {
+		return left / right
+	}
+	return left % right
+}
+
+// Evaluate a unary operator or a single value
+func (e *ppExpr) unary() int64 {
+	if e.pos == len(e.tokens) {
+		fatal("missing value in #if on line %d\n", e.line)
+	}
+	t := e.tokens[e.pos]
+	e.pos++
+	switch {
+	case t.text == "(":
+		value := e.ternary()
+		e.expect(")")
+		return value
+	case t.text == "!":
+		if e.unary() == 0 {
+			return 1
+		}
+		return 0
+	case t.text == "~":
+		return ^e.unary()
+	case t.text == "-":
+		return -e.unary()
+	case t.text == "+":
+		return e.unary()
+	case t.kind == ppIdent:
+		// Any name which isn't a macro is zero
+		return 0
+	case t.kind == ppNumber:
+		value, err := strconv.ParseInt(strings.TrimRight(t.text, "uUlL"), 0, 64)
+		if err != nil {
+			fatal("bad number %s in #if on line %d\n", t.text, e.line)
+		}
+		return value
+	case t.kind == ppString && t.text[0] == '\'':
+		ppterminated(t, e.line)
+		return ppchar(t.text, e.line)
+	}
+	fatal("unexpected %s in #if on line %d\n", t.text, e.line)
+	return 0
+}
+
+// Return the value of a character constant in an #if
+func ppchar(s string, line int) int64 {
+	s = s[1 : len(s)-1]
+	if len(s) == 1 {
+		return int64(s[0])
+	}
+	if len(s) > 1 && s[0] == '\\' {
+		if k := strings.IndexByte("abfnrtv", s[1]); k >= 0 && len(s) == 2 {
+			return int64("\a\b\f\n\r\t\v"[k])
+		}
+		if len(s) == 2 && strings.IndexByte("\\'\"?", s[1]) >= 0 {
+			return int64(s[1])
+		}
+		// Octal and hex escapes
+		base, digits := 8, s[1:]
+		if s[1] == 'x' {
+			base, digits = 16, s[2:]
+		}
+		if value, err := strconv.ParseInt(digits, base, 64); err == nil && value <= 0xff {
+			return value
+		}
+	}
+	fatal("bad character constant '%s' in #if on line %d\n", s, line)
+	return 0
+}
@@ -17,7 +17,9 @@ const (
 	TokenMinus                        // -
 	TokenStar                         // *
 	TokenSlash                        // /
+	TokenPercent                      // %
 	TokenIntLiteral                   // 0
+	TokenStringLiteral                // "abc"
 	TokenSemicolon                    // ;
 	TokenAssign                       // =
 	TokenEqual                        // ==
@@ -27,54 +29,115 @@ const (
 	TokenGreaterThan                  // >
 	TokenGreaterThanOrEqual           // >=
 
-	TokenAmpersand // &
-	TokenAnd       // &&
-	TokenComma     // ,
+	TokenAmpersand  // &
+	TokenAnd        // &&
+	TokenOr         // ||
+	TokenLogicalNot // !
+	TokenInvert     // ~
+	TokenPipe       // |
+	TokenCaret      // ^
+	TokenLeftShift  // <<
+	TokenRightShift // >>
 
-	TokenLeftBrace  // {
-	TokenRightBrace // }
-	TokenLeftParen  // (
-	TokenRightParen // )
+	TokenIncrement        // ++
+	TokenDecrement        // --
+	TokenAssignPlus       // +=
+	TokenAssignMinus      // -=
+	TokenAssignStar       // *=
+	TokenAssignSlash      // /=
+	TokenAssignPercent    // %=
+	TokenAssignAmpersand  // &=
+	TokenAssignPipe       // |=
+	TokenAssignCaret      // ^=
+	TokenAssignLeftShift  // <<=
+	TokenAssignRightShift // >>=
+	TokenComma            // ,
+	TokenDot              // .
+	TokenArrow            // ->
+	TokenQuestion         // ?
+	TokenColon            // :
 
-	TokenIf    // if
-	TokenElse  // else
-	TokenWhile // while
-	TokenFor   // for
-	TokenVoid  // void
+	TokenLeftBrace    // {
+	TokenRightBrace   // }
+	TokenLeftParen    // (
+	TokenRightParen   // )
+	TokenLeftBracket  // [
+	TokenRightBracket // ]
+
+	TokenIf       // if
+	TokenElse     // else
+	TokenWhile    // while
+	TokenFor      // for
+	TokenDo       // do
+	TokenBreak    // break
+	TokenContinue // continue
+	TokenSwitch   // switch
+	TokenCase     // case
+	TokenDefault  // default
+	TokenGoto     // goto
+	TokenVoid     // void
 
 	TokenIdent // x
 
-	TokenPrint  // print
-	TokenInt    // int
-	TokenChar   // char
-	TokenLong   // long
-	TokenReturn // return
+	TokenPrint    // print
+	TokenInt      // int
+	TokenChar     // char
+	TokenLong     // long
+	TokenReturn   // return
+	TokenStruct   // struct
+	TokenUnion    // union
+	TokenConst    // const
+	TokenVolatile // volatile
 )
 
 // Token structure
 type Token struct {
-	token TokenType
-	value int
+	token    TokenType
+	value    int
+	comments []Comment // The comments between the previous token and this one
+}
+
+// Comment is a comment in the input. The scanner
+// skips it like whitespace, but keeps it with the
+// token that follows it
+type Comment struct {
+	line int    // The line the comment starts on
+	text string // The text between the comment markers
 }
 
+// The comments skipped since the last token
+var pendingComments []Comment
+
 var (
 	Line       int  = 1
+	Filename        = "" // The file which Line is in
 	Putback    rune = '\n'
 	Text            = ""
 	FunctionId int  = -1
 )
 
 var Keywords = map[string]TokenType{
-	"print":  TokenPrint,
-	"int":    TokenInt,
-	"if":     TokenIf,
-	"else":   TokenElse,
-	"while":  TokenWhile,
-	"for":    TokenFor,
-	"void":   TokenVoid,
-	"char":   TokenChar,
-	"long":   TokenLong,
-	"return": TokenReturn,
+	"print":    TokenPrint,
+	"int":      TokenInt,
+	"if":       TokenIf,
+	"else":     TokenElse,
+	"while":    TokenWhile,
+	"for":      TokenFor,
+	"do":       TokenDo,
+	"break":    TokenBreak,
+	"continue": TokenContinue,
+	"switch":   TokenSwitch,
+	"case":     TokenCase,
+	"default":  TokenDefault,
+	"goto":     TokenGoto,
+	"void":     TokenVoid,
+	"char":     TokenChar,
+	"long":     TokenLong,
+	"return":   TokenReturn,
+	"struct":   TokenStruct,
+	"union":    TokenUnion,
+	"const":    TokenConst,
+	"volatile": TokenVolatile,
 }
 
 const (
@@ -103,20 +166,108 @@ func next() rune {
 	return c
 }
 
+// If the next character is c, skip it and return
+// true. Otherwise put it back and return false
+func nextIs(c rune) bool {
+	if d := next(); d != c {
+		putback(d)
+		return false
+	}
+	return true
+}
+
 // Put back an unwanted character
 func putback(c rune) {
 	Putback = c
 }
 
 // Skip past input that we don't need to deal with,
-// i.e. whitespace, newlines. Return the first
-// character we do need to deal with.
+// i.e. whitespace, newlines and comments. Return the
+// first character we do need to deal with.
 func skip() rune {
+	for {
+		c := next()
+		for c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' {
+			c = next()
+		}
+		// Line markers from the preprocessor
+		// start with a '#', and nothing else does
+		if c == '#' {
+			linemarker()
+			continue
+		}
+		if c != '/' {
+			return c
+		}
+		// A '/' could start a comment or be a divide
+		line := Line
+		switch d := next(); d {
+		case '/':
+			pendingComments = append(pendingComments, Comment{line, linecomment()})
+		case '*':
+			pendingComments = append(pendingComments, Comment{line, blockcomment(line)})
+		default:
+			putback(d)
+			return c
+		}
+	}
+}
+
+// Read the rest of a line marker, which gives the
+// number and file name of the line after it
+func linemarker() {
+	buf := make([]rune, 0)
+	for c := next(); c != '\n' && c != EOF; c = next() {
+		buf = append(buf, c)
+	}
+	var line int
+	var name string
+	if _, err := fmt.Sscanf(string(buf), "line %d %q", &line, &name); err != nil {
+		fatal("bad line marker on line %d\n", Line)
+	}
+	Line, Filename = line, name
+}
+
+// Skip the rest of a '//' comment up to the
+// end of the line and return its text
+func linecomment() string {
+	buf := make([]rune, 0)
+	for {
+		c := next()
+		if c == '\n' || c == EOF {
+			putback(c)
+			return string(buf)
+		}
+		buf = append(buf, c)
+	}
+}
+
+// Skip the rest of a '/*' comment which started on
+// the given line, up to the '*/', and return its text.
+// Comments don't nest, so warn about a '/*' inside one
+func blockcomment(line int) string {
+	buf := make([]rune, 0)
 	c := next()
-	for c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' {
+	for {
+		switch c {
+		case EOF:
+			fatal("unterminated comment starting on line %d\n", line)
+		case '*':
+			if c = next(); c == '/' {
+				return string(buf)
+			}
+			buf = append(buf, '*')
+			continue
+		case '/':
+			if c = next(); c == '*' {
+				warning("\"/*\" within comment on line %d\n", Line)
+			}
+			buf = append(buf, '/')
+			continue
+		}
+		buf = append(buf, c)
 		c = next()
 	}
-	return c
 }
 
 // Scan and return an integer literal
@@ -137,6 +288,129 @@ func scanint(c rune) int {
 	return val
 }
 
+// Scan the rest of an escape sequence after the '\\'
+// and return the byte that it stands for
+func scanescape() byte {
+	c := next()
+	switch c {
+	case 'a':
+		return '\a'
+	case 'b':
+		return '\b'
+	case 'f':
+		return '\f'
+	case 'n':
+		return '\n'
+	case 'r':
+		return '\r'
+	case 't':
+		return '\t'
+	case 'v':
+		return '\v'
+	case '\\', '\'', '"', '?':
+		return byte(c)
+	case 'x':
+		// A hex escape has at least one digit
+		val, digits := scandigits(next(), 16, 0)
+		if digits == 0 {
+			fatal("\\x used with no hex digits on line %d\n", Line)
+		}
+		if val > 0xff {
+			fatal("hex escape sequence out of range on line %d\n", Line)
+		}
+		return byte(val)
+	}
+	if c >= '0' && c <= '7' {
+		// An octal escape has up to three digits
+		val, _ := scandigits(c, 8, 3)
+		if val > 0xff {
+			fatal("octal escape sequence out of range on line %d\n", Line)
+		}
+		return byte(val)
+	}
+	fatal("unknown escape sequence \\%c on line %d\n", c, Line)
+	return 0
+}
+
+// Scan up to lim digits in the given base, or any number
+// if lim is zero, starting with c. Return their value
+// and the number of digits
+func scandigits(c rune, base, lim int) (int, int) {
+	val, digits := 0, 0
+	for lim == 0 || digits < lim {
+		k := strings.IndexRune("0123456789abcdef"[:base], unicode.ToLower(c))
+		if k < 0 {
+			break
+		}
+		// Stop the value growing without limit
+		// once it is known to be out of range
+		if val <= 0xff {
+			val = val*base + k
+		}
+		digits++
+		c = next()
+	}
+	// We hit a character which isn't a digit, put it back.
+	putback(c)
+	return val, digits
+}
+
+// Scan a character literal from the input file after
+// the opening quote. Return the value of the character
+func scanchr() int {
+	line := Line
+	c := next()
+	var val int
+	switch c {
+	case '\'':
+		fatal("empty character literal on line %d\n", line)
+	case '\\':
+		val = int(scanescape())
+	case '\n', EOF:
+		fatal("unterminated character literal on line %d\n", line)
+	default:
+		val = int(c)
+	}
+	c = next()
+	if c == '\'' && val <= 0xff {
+		return val
+	}
+	// Find the end of the literal to tell the
+	// two kinds of mistake apart
+	for c != '\'' {
+		if c == '\n' || c == EOF {
+			fatal("unterminated character literal on line %d\n", line)
+		}
+		if c == '\\' {
+			next()
+		}
+		c = next()
+	}
+	fatal("multi-character character literal on line %d\n", line)
+	return 0
+}
+
+// Scan a string literal from the input file after the
+// opening '"'. Return its contents with the escape
+// sequences replaced by the bytes they stand for
+func scanstr() string {
+	buf := make([]byte, 0)
+	line := Line
+	for {
+		c := next()
+		switch c {
+		case '"':
+			return string(buf)
+		case '\\':
+			buf = append(buf, scanescape())
+		case '\n', EOF:
+			fatal("unterminated string literal on line %d\n", line)
+		default:
+			buf = append(buf, string(c)...)
+		}
+	}
+}
+
 // Scan an identifier from the input file and
 // store it in buf[]. Return the identifier's length
 func scanident(c rune, lim int) string {
@@ -176,10 +450,6 @@ func semi() {
 	match(TokenSemicolon, ";")
 }
 
-func ident() {
-	match(TokenIdent, "identifier")
-}
-
 func lbrace() {
 	match(TokenLeftBrace, "{")
 }
@@ -204,30 +474,83 @@ func rejectToken(t *Token) {
 	RejectedToken = t
 }
 
+// The text of the token returned by peek()
+var peekedText string
+
+// Return the token after the current one without
+// moving past the current one. Text is left alone
+// and the next call to scan() returns the token
+func peek() *Token {
+	if RejectedToken == nil {
+		text := Text
+		t := &Token{}
+		scan(t)
+		RejectedToken, peekedText = t, Text
+		Text = text
+	}
+	return RejectedToken
+}
+
 // Scan and return the next token found in the input.
 // Return 1 if token valid, 0 if no tokens left.
 func scan(t *Token) bool {
-	// If we have any rejected token, return it
+	// If we have any rejected or peeked token, return it
 	if RejectedToken != nil {
-		t = RejectedToken
+		if RejectedToken != t {
+			*t = *RejectedToken
+			Text = peekedText
+		}
 		RejectedToken = nil
 		return true
 	}
-	// Skip whitespace
+	// Skip whitespace and comments, and
+	// keep the comments with this token
 	c := skip()
+	t.comments = pendingComments
+	pendingComments = nil
 	// Determine the token based on the input character
 	switch c {
 	case EOF:
 		t.token = TokenEOF
 		return false
 	case '+':
-		t.token = TokenPlus
+		if nextIs('+') {
+			t.token = TokenIncrement
+		} else if nextIs('=') {
+			t.token = TokenAssignPlus
+		} else {
+			t.token = TokenPlus
+		}
 	case '-':
-		t.token = TokenMinus
+		if nextIs('>') {
+			t.token = TokenArrow
+		} else if nextIs('-') {
+			t.token = TokenDecrement
+		} else if nextIs('=') {
+			t.token = TokenAssignMinus
+		} else {
+			t.token = TokenMinus
+		}
+	case '.':
+		t.token = TokenDot
 	case '*':
-		t.token = TokenStar
+		if nextIs('=') {
+			t.token = TokenAssignStar
+		} else {
+			t.token = TokenStar
+		}
 	case '/':
-		t.token = TokenSlash
+		if nextIs('=') {
+			t.token = TokenAssignSlash
+		} else {
+			t.token = TokenSlash
+		}
+	case '%':
+		if nextIs('=') {
+			t.token = TokenAssignPercent
+		} else {
+			t.token = TokenPercent
+		}
 	case ';':
 		t.token = TokenSemicolon
 	case '{':
@@ -238,8 +561,16 @@ func scan(t *Token) bool {
 		t.token = TokenLeftParen
 	case ')':
 		t.token = TokenRightParen
+	case '[':
+		t.token = TokenLeftBracket
+	case ']':
+		t.token = TokenRightBracket
 	case ',':
 		t.token = TokenComma
+	case '?':
+		t.token = TokenQuestion
+	case ':':
+		t.token = TokenColon
 	case '=':
 		c = next()
 		if c == '=' {
@@ -253,33 +584,73 @@ func scan(t *Token) bool {
 		if c == '=' {
 			t.token = TokenNotEqual
 		} else {
-			fatal("unrecognized character %c\n", c)
+			putback(c)
+			t.token = TokenLogicalNot
 		}
+	case '~':
+		t.token = TokenInvert
 	case '<':
 		c = next()
 		if c == '=' {
 			t.token = TokenLessThanOrEqual
+		} else if c == '<' {
+			if nextIs('=') {
+				t.token = TokenAssignLeftShift
+			} else {
+				t.token = TokenLeftShift
+			}
 		} else {
 			putback(c)
 			t.token = TokenLessThan
 		}
-		break
 	case '>':
 		c = next()
 		if c == '=' {
 			t.token = TokenGreaterThanOrEqual
+		} else if c == '>' {
+			if nextIs('=') {
+				t.token = TokenAssignRightShift
+			} else {
+				t.token = TokenRightShift
+			}
 		} else {
 			putback(c)
 			t.token = TokenGreaterThan
 		}
+	case '"':
+		Text = scanstr()
+		t.token = TokenStringLiteral
+	case '\'':
+		// A character literal is an integer
+		// literal with the character's value
+		t.value = scanchr()
+		t.token = TokenIntLiteral
 	case '&':
 		c = next()
 		if c == '&' {
 			t.token = TokenAnd
+		} else if c == '=' {
+			t.token = TokenAssignAmpersand
 		} else {
 			putback(c)
 			t.token = TokenAmpersand
 		}
+	case '|':
+		c = next()
+		if c == '|' {
+			t.token = TokenOr
+		} else if c == '=' {
+			t.token = TokenAssignPipe
+		} else {
+			putback(c)
+			t.token = TokenPipe
+		}
+	case '^':
+		if nextIs('=') {
+			t.token = TokenAssignCaret
+		} else {
+			t.token = TokenCaret
+		}
 	default:
 		if unicode.IsDigit(c) {
 			t.value = scanint(c)
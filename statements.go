@@ -1,35 +1,72 @@
 package main
 
 // Parse a compound statement
-// and return its AST
-func compoundStatement() *ASTNode {
-	var tree, left *ASTNode
+// and return its AST. The statement has its own
+// scope for declarations, unless it is a function's
+// body, which shares the scope of the parameters
+func compoundStatement(ownScope bool) *ASTNode {
+	var left *ASTNode
 	// Require a left curly bracket
 	lbrace()
-	for {
-		// Parse a single statement
-		tree = singleStatement()
-		// Some statements must be followed by a semicolon
-		if tree != nil && (tree.op == OpPrint || tree.op == OpAssign || tree.op == OpReturn || tree.op == OpFunctionCall) {
-			semi()
-		}
-		// For each new tree, either save it in left
-		// if left is empty, or glue the left and the
-		// new tree together
-		if tree != nil {
-			if left == nil {
-				left = tree
-			} else {
-				left = NewASTNode(OpGlue, NodeNone, left, nil, tree, 0)
-			}
-			// When we hit a right curly bracket,
-			// skip past it and return the AST
-			if CurrentToken.token == TokenRightBrace {
-				rbrace()
-				return left
-			}
-		}
+	if ownScope {
+		PushScope()
+	}
+	// Parse statements until the right curly
+	// bracket. Empty statements and declarations
+	// without initial values have no AST
+	for CurrentToken.token != TokenRightBrace {
+		left = glue(left, statement())
 	}
+	rbrace()
+	if ownScope {
+		PopScope()
+	}
+	return left
+}
+
+// Glue a new tree onto the statements before it and
+// return the result. Either of them can be nil
+func glue(left, tree *ASTNode) *ASTNode {
+	if left == nil {
+		return tree
+	}
+	if tree == nil {
+		return left
+	}
+	return NewASTNode(OpGlue, nil, left, nil, tree, 0)
+}
+
+// Parse a statement, including any semicolon
+// which ends it, and return its AST. This can
+// be a compound statement or an empty one
+func statement() *ASTNode {
+	switch CurrentToken.token {
+	case TokenSemicolon:
+		// An empty statement
+		semi()
+		return nil
+	case TokenLeftBrace:
+		return compoundStatement(true)
+	}
+	// Declarations skip their own semicolon
+	declaration := isTypeToken(CurrentToken.token)
+	tree := singleStatement()
+	// Some statements must be followed by a semicolon
+	if tree != nil && !declaration && needsSemicolon(tree) {
+		semi()
+	}
+	return tree
+}
+
+// Return true if the statement must be followed
+// by a semicolon. Those which end with another
+// statement have already had theirs matched
+func needsSemicolon(tree *ASTNode) bool {
+	switch tree.op {
+	case OpIf, OpWhile, OpGlue, OpSwitch, OpLabel:
+		return false
+	}
+	return true
 }
 
 // Parse a single statement
@@ -38,26 +75,46 @@ func singleStatement() *ASTNode {
 	switch CurrentToken.token {
 	case TokenPrint:
 		return printStatement()
-	case TokenChar, TokenInt, TokenLong:
+	case TokenChar, TokenInt, TokenLong, TokenVoid, TokenStruct, TokenUnion, TokenConst, TokenVolatile:
 		// The beginning of a variable declaration.
-		// Parse the type and get the identifier.
+		// Parse the type and the first declarator.
 		// Then parse the rest of the declaration.
 		t := parseType()
-		ident()
-		varDeclaration(t)
-		return nil // No AST generated here
-	case TokenIdent:
-		return assignmentStatement()
+		if CurrentToken.token == TokenSemicolon {
+			// Only a struct or union was declared
+			scan(CurrentToken)
+			return nil
+		}
+		// Only the initial values generate any code
+		return varDeclaration(t, parseDeclarator(t), ClassLocal)
 	case TokenIf:
 		return ifStatement()
 	case TokenWhile:
 		return whileStatement()
 	case TokenFor:
 		return forStatement()
+	case TokenDo:
+		return doWhileStatement()
+	case TokenBreak, TokenContinue:
+		return jumpStatement()
+	case TokenSwitch:
+		return switchStatement()
+	case TokenCase, TokenDefault:
+		fatal("case label not directly inside a switch on line %d\n", Line)
 	case TokenReturn:
 		return returnStatement()
+	case TokenGoto:
+		return gotoStatement()
+	case TokenIdent:
+		// An identifier followed by a ':' is a label
+		if peek().token == TokenColon {
+			return labelStatement()
+		}
+		return binexpr(0)
 	default:
-		fatal("Syntax error, token %d\n", CurrentToken.token)
+		// Anything else is an expression, such
+		// as an assignment or a function call
+		return binexpr(0)
 	}
 	return nil
 }
@@ -68,35 +125,23 @@ func printStatement() *ASTNode {
 	// Parse the following expression
 	tree := binexpr(0)
 	// Ensure the two types are compatible.
-	_, rightOp, ok := typeCompatible(NodeInt, tree.t, false)
+	_, rightOp, ok := typeCompatible(TypeInt, tree.t, false)
 	if !ok {
 		fatal("incompatible types\n")
 	}
 	// Widen the tree if required.
 	if rightOp != nil {
-		tree = NewUnaryASTNode(*rightOp, NodeInt, tree, 0)
+		tree = NewUnaryASTNode(*rightOp, TypeInt, tree, 0)
 	}
 	// Make an print AST tree
-	tree = NewUnaryASTNode(OpPrint, NodeNone, tree, 0)
+	tree = NewUnaryASTNode(OpPrint, nil, tree, 0)
 	// Return the AST
 	return tree
 }
 
-func assignmentStatement() *ASTNode {
-	// Ensure we have an identifier
-	ident()
-	// This could be a variable or a function call.
-	// If next token is '(', it's a function call
-	if CurrentToken.token == TokenLeftParen {
-		return funccall()
-	}
-	// Not a function call, on with an assignment then!
-	sym := GetSymbolByString(Text)
-	right := NewLeafASTNode(OpLvIdent, sym.t, sym.id)
-	// Ensure we have an equals sign
-	match(TokenAssign, "=")
-	// Parse the following expression
-	left := binexpr(0)
+// Build the AST tree which assigns the value in left
+// to the lvalue in right
+func assign(left, right *ASTNode) *ASTNode {
 	// Ensure the two types are compatible.
 	leftOp, _, ok := typeCompatible(left.t, right.t, true)
 	if !ok {
@@ -106,8 +151,20 @@ func assignmentStatement() *ASTNode {
 	if leftOp != nil {
 		left = NewUnaryASTNode(*leftOp, right.t, left, 0)
 	}
-	// Make an assignment AST tree
-	return NewASTNode(OpAssign, NodeInt, left, nil, right, 0)
+	// Make an assignment AST tree, whose value
+	// is the value stored in the lvalue
+	return NewASTNode(OpAssign, right.t, left, nil, right, 0)
+}
+
+// Parse the condition of an IF, WHILE or FOR statement
+// and return its AST. Any integer or pointer can be a
+// condition, which is true if it isn't zero
+func condition() *ASTNode {
+	tree := binexpr(0)
+	if !tree.t.isScalar() {
+		fatal("condition must be an integer or pointer on line %d\n", Line)
+	}
+	return tree
 }
 
 // Parse an IF statement including
@@ -118,24 +175,20 @@ func ifStatement() *ASTNode {
 	match(TokenIf, "if")
 	lparen()
 	// Parse the following expression
-	// and the ')' following. Ensure
-	// the tree's operation is a comparison.
-	condAST := binexpr(0)
-	if condAST.op < OpEqual || condAST.op > OpGreaterThanOrEqual {
-		fatal("bad comparison operator\n")
-	}
+	// and the ')' following
+	condAST := condition()
 	rparen()
-	// Get the AST for the compound statement
-	trueAST := compoundStatement()
+	// Get the AST for the statement
+	trueAST := statement()
 	// If we have an 'else', skip it
-	// and get the AST for the compound statement
+	// and get the AST for the statement
 	var falseAST *ASTNode
 	if CurrentToken.token == TokenElse {
 		scan(CurrentToken)
-		falseAST = compoundStatement()
+		falseAST = statement()
 	}
 	// Build and return the AST for this statement
-	return NewASTNode(OpIf, NodeNone, condAST, trueAST, falseAST, 0)
+	return NewASTNode(OpIf, nil, condAST, trueAST, falseAST, 0)
 }
 
 // Parse a WHILE statement
@@ -145,17 +198,26 @@ func whileStatement() *ASTNode {
 	match(TokenWhile, "while")
 	lparen()
 	// Parse the following expression
-	// and the ')' following. Ensure
-	// the tree's operation is a comparison.
-	condAST := binexpr(0)
-	if condAST.op < OpEqual || condAST.op > OpGreaterThanOrEqual {
-		fatal("bad comparison operator")
-	}
+	// and the ')' following
+	condAST := condition()
 	rparen()
-	// Get the AST for the compound statement
-	bodyAST := compoundStatement()
+	// Get the AST for the statement
+	bodyAST := loopBody()
 	// Build and return the AST for this statement
-	return NewASTNode(OpWhile, NodeNone, condAST, nil, bodyAST, 0)
+	return NewASTNode(OpWhile, nil, condAST, nil, bodyAST, 0)
+}
+
+// Parse a DO WHILE statement and return its
+// AST. The body always runs at least once
+func doWhileStatement() *ASTNode {
+	match(TokenDo, "do")
+	bodyAST := loopBody()
+	match(TokenWhile, "while")
+	lparen()
+	condAST := condition()
+	rparen()
+	// The ';' is left for the caller to match
+	return NewASTNode(OpDoWhile, nil, condAST, nil, bodyAST, 0)
 }
 
 // Parse a FOR statement
@@ -164,45 +226,86 @@ func forStatement() *ASTNode {
 	// Ensure we have 'for' '('
 	match(TokenFor, "for")
 	lparen()
-	// Get the pre_op statement and the ';'
-	preopAST := singleStatement()
+	// Get the pre_op statement and the ';'.
+	// Any of the three clauses can be missing
+	var preopAST, condAST, postopAST *ASTNode
+	if CurrentToken.token != TokenSemicolon {
+		preopAST = singleStatement()
+	}
 	semi()
-	// Get the condition and the ';'
-	condAST := binexpr(0)
-	if condAST.op < OpEqual || condAST.op > OpGreaterThanOrEqual {
-		fatal("Bad comparison operator")
+	// Get the condition and the ';'. Without
+	// one, the loop only ends with a break
+	if CurrentToken.token != TokenSemicolon {
+		condAST = condition()
 	}
 	semi()
 	// Get the post_op statement and the ')'
-	postopAST := singleStatement()
+	if CurrentToken.token != TokenRightParen {
+		postopAST = singleStatement()
+	}
 	rparen()
-	// Get the compound statement which is the body
-	bodyAST := compoundStatement()
-	// For now, all four sub-trees have to be non-NULL.
-	// Later on, we'll change the semantics for when some are missing
-	// Glue the compound statement and the postop tree
-	tree := NewASTNode(OpGlue, NodeNone, bodyAST, nil, postopAST, 0)
-	// Make a WHILE loop with the condition and this new body
-	tree = NewASTNode(OpWhile, NodeNone, condAST, nil, tree, 0)
+	// Get the statement which is the body
+	bodyAST := loopBody()
+	// Make a WHILE loop with the condition, the body and
+	// the postop tree, which is where a continue goes
+	tree := NewASTNode(OpWhile, nil, condAST, postopAST, bodyAST, 0)
 	// And glue the preop tree to the A_WHILE tree
-	return NewASTNode(OpGlue, NodeNone, preopAST, nil, tree, 0)
+	if preopAST == nil {
+		return tree
+	}
+	return NewASTNode(OpGlue, nil, preopAST, nil, tree, 0)
+}
+
+// How many loops and switches the statement being
+// parsed is inside. A break needs either, but a
+// continue needs a loop
+var loopDepth, switchDepth int
+
+// Parse the body of a loop, inside
+// which break and continue can be used
+func loopBody() *ASTNode {
+	loopDepth++
+	tree := statement()
+	loopDepth--
+	return tree
 }
 
-// Parse a return statement and return its AST
+// Parse a BREAK or CONTINUE statement and
+// return its AST. The ';' is left for the caller
+func jumpStatement() *ASTNode {
+	op, name := OpBreak, "break"
+	if CurrentToken.token == TokenContinue {
+		op, name = OpContinue, "continue"
+	}
+	if loopDepth == 0 && (op == OpContinue || switchDepth == 0) {
+		fatal("%s outside a loop on line %d\n", name, Line)
+	}
+	scan(CurrentToken)
+	return NewLeafASTNode(op, nil, 0)
+}
+
+// Parse a return statement and return its AST.
+// The ';' is left for the caller to match
 func returnStatement() *ASTNode {
 	sym := GetSymbolByID(FunctionId)
+	match(TokenReturn, "return")
+	// Only a void function can return without a value
+	if CurrentToken.token == TokenSemicolon {
+		if sym.t.base.kind != KindVoid {
+			fatal("return without a value in %s on line %d\n", sym.name, Line)
+		}
+		return NewLeafASTNode(OpReturn, nil, 0)
+	}
 	// Can't return a value if function returns P_VOID
-	if sym.t == NodeVoid {
-		fatal("Can't return from a void function\n")
+	if sym.t.base.kind == KindVoid {
+		fatal("can't return a value from void function %s on line %d\n", sym.name, Line)
 	}
-	// Ensure we have 'return' '('
-	match(TokenReturn, "return")
-	lparen()
-	// Parse the following expression
+	// Parse the following expression. Any
+	// parentheses are part of the expression
 	tree := binexpr(0)
 	// Ensure this is compatible with the function's type
 	returnType := tree.t
-	funcType := sym.t
+	funcType := sym.t.base
 	_, rightOp, ok := typeCompatible(returnType, funcType, true)
 	if !ok {
 		fatal("incompatible types\n")
@@ -212,8 +315,191 @@ func returnStatement() *ASTNode {
 		tree = NewUnaryASTNode(*rightOp, funcType, tree, 0)
 	}
 	// Add on the A_RETURN node
-	tree = NewUnaryASTNode(OpReturn, NodeNone, tree, 0)
-	// Get the ')'
+	return NewUnaryASTNode(OpReturn, nil, tree, 0)
+}
+
+// Return true if control can reach the end of the statement,
+// given whether it can reach the start. Any label can be
+// jumped to, which makes what follows it reachable again.
+// A condition can be true or false unless it is a constant
+func reachesEnd(tree *ASTNode, reachable bool) bool {
+	if tree == nil {
+		return reachable
+	}
+	switch tree.op {
+	case OpGlue:
+		return reachesEnd(tree.right, reachesEnd(tree.left, reachable))
+	case OpLabel:
+		return true
+	case OpReturn, OpGoto, OpBreak, OpContinue:
+		return false
+	case OpIf:
+		// Either branch can be taken. A missing
+		// ELSE branch falls through to the end
+		trueEnd := reachesEnd(tree.middle, reachable)
+		falseEnd := reachesEnd(tree.right, reachable)
+		return trueEnd || falseEnd
+	case OpWhile, OpDoWhile:
+		// A loop ends when it breaks, or when its condition
+		// is false. The condition is reached from the loop's
+		// start or the end of its body, or by a continue
+		bodyEnd := reachesEnd(tree.right, reachable)
+		if jumpsOut(tree.right, OpBreak) {
+			return true
+		}
+		if tree.left == nil {
+			return false
+		}
+		// A condition which can't be folded, such as
+		// one which divides by zero, may be false
+		if value, ok := constantValue(tree.left); ok && value != 0 {
+			return false
+		}
+		testReached := bodyEnd || jumpsOut(tree.right, OpContinue)
+		if tree.op == OpWhile {
+			testReached = testReached || reachable
+		}
+		return testReached
+	case OpSwitch:
+		// The end is reached by a break, by a value
+		// which no case matches when there is no
+		// default, or by falling out of the last case
+		if jumpsOut(tree.right, OpBreak) {
+			return true
+		}
+		end := reachable
+		for c := tree.right; c != nil; c = c.right {
+			if c.op == OpDefault {
+				end = false
+			}
+			if c.right == nil {
+				end = end || reachesEnd(c.left, reachable)
+			}
+		}
+		return end
+	}
+	return reachable
+}
+
+// Return true if the statement has a break or a continue,
+// given by op, which leaves it. Those which belong to
+// a loop or switch inside the statement don't count
+func jumpsOut(tree *ASTNode, op OpType) bool {
+	if tree == nil {
+		return false
+	}
+	switch tree.op {
+	case op:
+		return true
+	case OpWhile, OpDoWhile:
+		return false
+	case OpSwitch:
+		if op == OpBreak {
+			return false
+		}
+	}
+	return jumpsOut(tree.left, op) || jumpsOut(tree.middle, op) || jumpsOut(tree.right, op)
+}
+
+// Parse a SWITCH statement and return its AST.
+// The cases are a list in the order they appear,
+// so that each one can fall through to the next
+func switchStatement() *ASTNode {
+	match(TokenSwitch, "switch")
+	lparen()
+	exprAST := binexpr(0)
+	if !exprAST.t.isInteger() {
+		fatal("switch value must be an integer on line %d\n", Line)
+	}
 	rparen()
-	return tree
+	lbrace()
+	PushScope()
+	switchDepth++
+	var first, last *ASTNode
+	count := 0
+	seen := make(map[int]bool)
+	hasDefault := false
+	for CurrentToken.token != TokenRightBrace {
+		var caseAST *ASTNode
+		switch CurrentToken.token {
+		case TokenCase:
+			scan(CurrentToken)
+			value, ok := constantValue(binexpr(0))
+			if !ok {
+				fatal("case value is not a constant on line %d\n", Line)
+			}
+			if seen[value] {
+				fatal("duplicate case value %d on line %d\n", value, Line)
+			}
+			seen[value] = true
+			caseAST = NewLeafASTNode(OpCase, nil, value)
+		case TokenDefault:
+			scan(CurrentToken)
+			if hasDefault {
+				fatal("duplicate default case on line %d\n", Line)
+			}
+			hasDefault = true
+			caseAST = NewLeafASTNode(OpDefault, nil, 0)
+		default:
+			fatal("expected case or default on line %d\n", Line)
+		}
+		match(TokenColon, ":")
+		caseAST.left = caseBody()
+		// Add the case to the end of the list
+		if first == nil {
+			first = caseAST
+		} else {
+			last.right = caseAST
+		}
+		last = caseAST
+		count++
+	}
+	switchDepth--
+	rbrace()
+	PopScope()
+	return NewASTNode(OpSwitch, nil, exprAST, nil, first, count)
+}
+
+// Parse the statements after a case label up to the
+// next label or the end of the switch, and return
+// their AST, which is nil if there aren't any
+func caseBody() *ASTNode {
+	var left *ASTNode
+	for {
+		switch CurrentToken.token {
+		case TokenCase, TokenDefault, TokenRightBrace:
+			return left
+		}
+		left = glue(left, statement())
+	}
+}
+
+// Parse a label and the statement it names,
+// and return their AST
+func labelStatement() *ASTNode {
+	l := FindLabel(Text)
+	if l.defined {
+		fatal("duplicate label %s on line %d, previously defined on line %d\n", l.name, Line, l.line)
+	}
+	l.defined, l.line = true, Line
+	scan(CurrentToken)
+	match(TokenColon, ":")
+	tree := NewLeafASTNode(OpLabel, nil, l.id)
+	// A label can end a compound statement
+	if CurrentToken.token == TokenRightBrace {
+		return tree
+	}
+	return glue(tree, statement())
+}
+
+// Parse a GOTO statement and return its AST.
+// The label can be defined later in the function
+func gotoStatement() *ASTNode {
+	match(TokenGoto, "goto")
+	if CurrentToken.token != TokenIdent {
+		fatal("expected a label after goto on line %d\n", Line)
+	}
+	l := FindLabel(Text)
+	scan(CurrentToken)
+	return NewLeafASTNode(OpGoto, nil, l.id)
 }
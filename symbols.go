@@ -4,36 +4,153 @@ import "fmt"
 
 const MaxSymbols = 1024
 
+// StorageClass
+type StorageClass int
+
+// Storage classes
+const (
+	ClassGlobal StorageClass = iota // Globally visible symbol
+	ClassLocal                      // Locally visible symbol
+	ClassParam                      // Locally visible function parameter
+	ClassMember                     // Member of a struct or union
+)
+
 type Symbol struct {
 	name     string
-	t        NodeType
+	t        *Type
 	st       StructuralNodeType
+	class    StorageClass
 	id       int
 	endLabel int
+	line     int       // The line the symbol was first declared on
+	defined  bool      // For functions, true once the body has been seen
+	defLine  int       // For functions, the line the body was defined on
+	posn     int       // For locals, the negative offset from the stack base pointer. For members, the offset in the struct
+	params   []*Symbol // For functions, the parameters in declaration order
+	locals   []*Symbol // For functions, the local variables declared in the body
 }
 
 func (s Symbol) String() string {
 	return fmt.Sprintf("Symbol '%s' ID: %d", s.name, s.id)
 }
 
+// Composite describes a struct or union type
+type Composite struct {
+	name    string
+	members []*Symbol // In declaration order
+	size    int       // Zero until the definition is complete
+	align   int
+	line    int
+}
+
+// Find a member of a struct or union by name.
+// Return nil if there is no such member
+func (c *Composite) member(name string) *Symbol {
+	for _, m := range c.members {
+		if m.name == name {
+			return m
+		}
+	}
+	return nil
+}
+
+// Label is a name which a goto can jump to. Labels are
+// kept apart from other symbols, and each function
+// has its own labels whatever the scope
+type Label struct {
+	name    string
+	id      int  // The number of the assembly label
+	defined bool // True once the labeled statement has been seen
+	line    int  // Where the label was first used or defined
+}
+
+// The labels of the function being parsed, by name
+var functionLabels = make(map[string]*Label)
+
+// Find a label in the current function by name,
+// adding it if it hasn't been seen before
+func FindLabel(name string) *Label {
+	l := functionLabels[name]
+	if l == nil {
+		l = &Label{name: name, id: label(), line: Line}
+		functionLabels[name] = l
+	}
+	return l
+}
+
+// Check that every label used in the function is
+// defined, then forget them ready for the next function
+func EndLabels() {
+	var undefined *Label
+	for _, l := range functionLabels {
+		if !l.defined && (undefined == nil || l.line < undefined.line) {
+			undefined = l
+		}
+	}
+	if undefined != nil {
+		fatal("label %s used on line %d is not defined\n", undefined.name, undefined.line)
+	}
+	functionLabels = make(map[string]*Label)
+}
+
+// A scope maps the names declared in it to their symbol IDs,
+// and the tags of the structs and unions declared in it to
+// their types. Tags are a separate namespace from names
+type scope struct {
+	names map[string]int
+	tags  map[string]*Type
+}
+
+// Return a new empty scope
+func newScope() scope {
+	return scope{names: make(map[string]int), tags: make(map[string]*Type)}
+}
+
 var (
-	symbolTable        = make(map[int]*Symbol, MaxSymbols)
-	inverseSymbolTable = make(map[string]int, MaxSymbols)
+	symbolTable = make(map[int]*Symbol, MaxSymbols)
+	// The stack of scopes that are currently open. The global
+	// scope is at the bottom and the innermost scope at the top
+	scopes = []scope{newScope()}
 )
 
-func AddSymbol(s string, t NodeType, st StructuralNodeType, endLabel int) *Symbol {
-	if _, exists := inverseSymbolTable[s]; exists {
-		fatal("symbol %s already declared", s)
+// Open a new scope, e.g. for a function's
+// parameters or a compound statement
+func PushScope() {
+	scopes = append(scopes, newScope())
+}
+
+// Close the innermost scope. The symbols declared in it
+// stay in the table so that their IDs remain valid
+func PopScope() {
+	if len(scopes) == 1 {
+		fatal("can't close the global scope\n")
+	}
+	scopes = scopes[:len(scopes)-1]
+}
+
+// Add a symbol to the symbol table. Globals go in the global scope,
+// and locals and parameters in the innermost scope. A name can only
+// be declared once per scope, but it hides the same name in any
+// enclosing scope.
+func AddSymbol(s string, t *Type, st StructuralNodeType, class StorageClass, endLabel int) *Symbol {
+	names := scopes[len(scopes)-1].names
+	if class == ClassGlobal {
+		names = scopes[0].names
+	}
+	if id, exists := names[s]; exists {
+		fatal("symbol %s already declared on line %d, previously declared on line %d\n", s, Line, symbolTable[id].line)
 	}
 	id := len(symbolTable)
 	symbolTable[id] = &Symbol{
 		name:     s,
 		t:        t,
 		st:       st,
+		class:    class,
 		id:       id,
 		endLabel: endLabel,
+		line:     Line,
 	}
-	inverseSymbolTable[s] = id
+	names[s] = id
 	return symbolTable[id]
 }
 
@@ -45,10 +162,44 @@ func GetSymbolByID(id int) *Symbol {
 	return s
 }
 
-func GetSymbolByString(s string) *Symbol {
-	id, ok := inverseSymbolTable[s]
+// Find a global symbol by name.
+// Return nil if there is no such symbol
+func FindGlobalSymbol(s string) *Symbol {
+	id, ok := scopes[0].names[s]
 	if !ok {
-		fatal("symbol %s does not exists", s)
+		return nil
 	}
 	return GetSymbolByID(id)
 }
+
+// Find a symbol by name, walking outwards from the
+// innermost scope so that the innermost declaration wins
+func GetSymbolByString(s string) *Symbol {
+	for i := len(scopes) - 1; i >= 0; i-- {
+		if id, ok := scopes[i].names[s]; ok {
+			return GetSymbolByID(id)
+		}
+	}
+	fatal("symbol %s does not exists on line %d\n", s, Line)
+	return nil
+}
+
+// Find a struct or union type by its tag, walking outwards
+// from the innermost scope, or only looking in the innermost
+// scope if innermost is true. Return nil if there is no such type
+func FindCompositeType(name string, innermost bool) *Type {
+	for i := len(scopes) - 1; i >= 0; i-- {
+		if t, ok := scopes[i].tags[name]; ok {
+			return t
+		}
+		if innermost {
+			break
+		}
+	}
+	return nil
+}
+
+// Add a struct or union type to the tags of the innermost scope
+func AddCompositeType(t *Type) {
+	scopes[len(scopes)-1].tags[t.composite.name] = t
+}
@@ -2,20 +2,6 @@ package main
 
 const NoReg = -1
 
-type NodeType int
-
-const (
-	NodeNone NodeType = iota
-	NodeVoid
-	NodeChar
-	NodeInt
-	NodeLong
-	NodeVoidPointer
-	NodeCharPointer
-	NodeIntPointer
-	NodeLongPointer
-)
-
 type StructuralNodeType int
 
 const (
@@ -33,8 +19,10 @@ const (
 	OpSubtract
 	OpMultiply
 	OpDivide
+	OpModulo
 
 	OpIntLiteral
+	OpStringLiteral
 
 	OpEqual
 	OpNotEqual
@@ -45,7 +33,15 @@ const (
 
 	OpGlue
 	OpIf
-	OpWhile
+	OpWhile // A FOR loop's post-op is the middle child
+	OpDoWhile
+	OpBreak
+	OpContinue
+	OpSwitch  // The value is the number of cases, including any default
+	OpCase    // The value is the case's value, the right child the next case
+	OpDefault // Like OpCase, but matches any value without a case
+	OpLabel   // The value is the assembly label
+	OpGoto
 	OpFunction
 	OpFunctionCall
 	OpReturn
@@ -58,18 +54,36 @@ const (
 
 	OpAddress
 	OpDereference
+	OpLvDereference
+	OpScale   // Multiply by the size of a pointer's target type
+	OpUnscale // Divide by the size of a pointer's target type
+
+	OpLogicalAnd
+	OpLogicalOr
+	OpNegate
+	OpLogicalNot
+	OpInvert
+	OpAnd
+	OpOr
+	OpXor
+	OpLeftShift
+	OpRightShift
+	OpCompoundAssign // Apply the operation in value to an lvalue, e.g. +=, ++x
+	OpPostIncrement
+	OpPostDecrement
+	OpTernary // Evaluate middle if left is true, otherwise right
 )
 
 // Abstract Syntax Tree structure
 type ASTNode struct {
 	op                  OpType
-	t                   NodeType
+	t                   *Type // nil for statements
 	left, middle, right *ASTNode
 	value               int
 }
 
 // Build and return a generic AST node
-func NewASTNode(op OpType, t NodeType, left, middle, right *ASTNode, value int) *ASTNode {
+func NewASTNode(op OpType, t *Type, left, middle, right *ASTNode, value int) *ASTNode {
 	return &ASTNode{
 		op:     op,
 		t:      t,
@@ -81,11 +95,11 @@ func NewASTNode(op OpType, t NodeType, left, middle, right *ASTNode, value int)
 }
 
 // Make an AST leaf node
-func NewLeafASTNode(op OpType, t NodeType, value int) *ASTNode {
+func NewLeafASTNode(op OpType, t *Type, value int) *ASTNode {
 	return NewASTNode(op, t, nil, nil, nil, value)
 }
 
 // Make a unary AST node: only one child
-func NewUnaryASTNode(op OpType, t NodeType, left *ASTNode, value int) *ASTNode {
+func NewUnaryASTNode(op OpType, t *Type, left *ASTNode, value int) *ASTNode {
 	return NewASTNode(op, t, left, nil, nil, value)
 }
@@ -1,54 +1,306 @@
 package main
 
-// Parse the current token and
-// return a primitive type enum value
-func parseType() NodeType {
-	nt := NodeType(0)
+import (
+	"fmt"
+	"strings"
+)
+
+// TypeKind
+type TypeKind int
+
+// Kinds of type
+const (
+	KindVoid TypeKind = iota
+	KindChar
+	KindInt
+	KindLong
+	KindPointer
+	KindArray
+	KindFunction
+	KindStruct
+	KindUnion
+)
+
+// Qualifier
+type Qualifier int
+
+// Type qualifiers, which can be combined
+const (
+	QualConst Qualifier = 1 << iota
+	QualVolatile
+)
+
+// Type is a node in the type graph. Derived types
+// point at the type they are derived from
+type Type struct {
+	kind       TypeKind
+	qualifiers Qualifier
+	base       *Type      // The target of a pointer, element of an array or return type of a function
+	length     int        // For arrays, the number of elements. Negative if unknown
+	params     []*Type    // For functions, the parameter types in order
+	composite  *Composite // For structs and unions, the members and layout
+	pointer    *Type      // The unqualified pointer to this type, once it has been needed
+}
+
+// The basic types
+var (
+	TypeVoid = &Type{kind: KindVoid}
+	TypeChar = &Type{kind: KindChar}
+	TypeInt  = &Type{kind: KindInt}
+	TypeLong = &Type{kind: KindLong}
+)
+
+func (t *Type) String() string {
+	var s string
+	switch t.kind {
+	case KindVoid:
+		s = "void"
+	case KindChar:
+		s = "char"
+	case KindInt:
+		s = "int"
+	case KindLong:
+		s = "long"
+	case KindPointer:
+		s = t.base.String() + " *"
+	case KindArray:
+		if t.length < 0 {
+			s = t.base.String() + " []"
+		} else {
+			s = fmt.Sprintf("%s [%d]", t.base, t.length)
+		}
+	case KindFunction:
+		params := make([]string, len(t.params))
+		for i, p := range t.params {
+			params[i] = p.String()
+		}
+		s = fmt.Sprintf("%s (%s)", t.base, strings.Join(params, ", "))
+	case KindStruct:
+		s = "struct " + t.composite.name
+	case KindUnion:
+		s = "union " + t.composite.name
+	}
+	if t.qualifiers&QualConst != 0 {
+		s = "const " + s
+	}
+	if t.qualifiers&QualVolatile != 0 {
+		s = "volatile " + s
+	}
+	return s
+}
+
+// Return true if the two types are the same, ignoring qualifiers
+func (t *Type) equal(u *Type) bool {
+	if t == u {
+		return true
+	}
+	if t.kind != u.kind {
+		return false
+	}
+	switch t.kind {
+	case KindPointer:
+		return t.base.equal(u.base)
+	case KindArray:
+		return t.length == u.length && t.base.equal(u.base)
+	case KindFunction:
+		if !t.base.equal(u.base) || len(t.params) != len(u.params) {
+			return false
+		}
+		for i := range t.params {
+			if !t.params[i].equal(u.params[i]) {
+				return false
+			}
+		}
+		return true
+	case KindStruct, KindUnion:
+		return t.composite == u.composite
+	}
+	return true
+}
+
+// Return true if the type is an integer of any size
+func (t *Type) isInteger() bool {
+	return t.kind == KindChar || t.kind == KindInt || t.kind == KindLong
+}
+
+// Return true if the type is an integer without a sign.
+// A char is zero-extended when it is loaded, so it is one
+func (t *Type) isUnsigned() bool {
+	return t.kind == KindChar
+}
+
+// Return true if the type is a pointer of any kind
+func (t *Type) isPointer() bool {
+	return t.kind == KindPointer
+}
+
+// Return true if the type is a struct or a union
+func (t *Type) isComposite() bool {
+	return t.kind == KindStruct || t.kind == KindUnion
+}
+
+// Return true if the type is an integer or a pointer
+func (t *Type) isScalar() bool {
+	return t.isInteger() || t.isPointer()
+}
+
+// Given a type, return the type which is a pointer to it
+func pointerTo(t *Type) *Type {
+	if t.pointer == nil {
+		t.pointer = &Type{kind: KindPointer, base: t}
+	}
+	return t.pointer
+}
+
+// Given a pointer type, return the type which it points to
+func valueAt(t *Type) *Type {
+	if t.kind != KindPointer {
+		fatal("%s is not a pointer on line %d\n", t, Line)
+	}
+	return t.base
+}
+
+// Return the type which is an array of the given length
+func arrayOf(t *Type, length int) *Type {
+	return &Type{kind: KindArray, base: t, length: length}
+}
+
+// Return the type of a function with the
+// given return type and parameter types
+func functionOf(t *Type, params []*Type) *Type {
+	return &Type{kind: KindFunction, base: t, params: params}
+}
+
+// Return the type with the given qualifiers added
+func qualified(t *Type, q Qualifier) *Type {
+	if q == 0 || t.qualifiers&q == q {
+		return t
+	}
+	qt := *t
+	qt.qualifiers |= q
+	qt.pointer = nil
+	return &qt
+}
+
+// Parse the current token and return the base type that it names,
+// including any struct or union definition and any qualifiers.
+// Pointers, arrays and functions are parsed by parseDeclarator
+func parseType() *Type {
+	q := parseQualifiers()
+	var t *Type
 	switch CurrentToken.token {
 	case TokenChar:
-		nt = NodeChar
+		t = TypeChar
 	case TokenInt:
-		nt = NodeInt
+		t = TypeInt
 	case TokenLong:
-		nt = NodeLong
+		t = TypeLong
 	case TokenVoid:
-		nt = NodeVoid
+		t = TypeVoid
+	case TokenStruct, TokenUnion:
+		t = compositeDeclaration(CurrentToken.token == TokenUnion)
 	default:
 		fatal("Illegal type, token %d\n", CurrentToken.token)
 	}
-	// Scan in one or more further '*' tokens
-	// and determine the correct pointer type
+	if !t.isComposite() {
+		scan(CurrentToken)
+	}
+	// We leave with the next token already scanned
+	return qualified(t, q|parseQualifiers())
+}
+
+// Parse any number of 'const' and 'volatile'
+// keywords and return the qualifiers they name
+func parseQualifiers() Qualifier {
+	var q Qualifier
 	for {
+		switch CurrentToken.token {
+		case TokenConst:
+			q |= QualConst
+		case TokenVolatile:
+			q |= QualVolatile
+		default:
+			return q
+		}
 		scan(CurrentToken)
-		if CurrentToken.token != TokenStar {
-			break
+	}
+}
+
+// Return true if the token can start a declaration
+func isTypeToken(t TokenType) bool {
+	switch t {
+	case TokenChar, TokenInt, TokenLong, TokenVoid, TokenStruct, TokenUnion, TokenConst, TokenVolatile:
+		return true
+	}
+	return false
+}
+
+// Build the AST tree for an addition or subtraction where at least
+// one side is a pointer. An integer added to or subtracted from a
+// pointer is scaled by the size of the type pointed to, and the
+// difference between two pointers of the same type is divided by
+// it to give the number of elements between them
+func pointerArithmetic(op OpType, left, right *ASTNode) *ASTNode {
+	if left.t.isPointer() && right.t.isPointer() {
+		if op == OpAdd {
+			fatal("can't add two pointers on line %d\n", Line)
 		}
-		nt = pointerTo(nt)
+		if !left.t.equal(right.t) {
+			fatal("can't subtract pointers to different types on line %d\n", Line)
+		}
+		size := pointeeSize(left.t)
+		tree := NewASTNode(OpSubtract, TypeLong, left, nil, right, 0)
+		if size > 1 {
+			tree = NewUnaryASTNode(OpUnscale, TypeLong, tree, size)
+		}
+		return tree
 	}
-	// We leave with the next token already scanned
-	return nt
+	// One side is a pointer and the other must be an integer
+	if !left.t.isPointer() && op == OpSubtract {
+		fatal("can't subtract a pointer from an integer on line %d\n", Line)
+	}
+	pointer, offset := left, right
+	if !left.t.isPointer() {
+		pointer, offset = right, left
+	}
+	if !offset.t.isInteger() {
+		fatal("pointer offset is not an integer on line %d\n", Line)
+	}
+	if size := pointeeSize(pointer.t); size > 1 {
+		offset = NewUnaryASTNode(OpScale, TypeLong, offset, size)
+	}
+	if pointer == left {
+		return NewASTNode(op, pointer.t, pointer, nil, offset, 0)
+	}
+	return NewASTNode(op, pointer.t, offset, nil, pointer, 0)
+}
+
+// Given a pointer type, return the size of the type it
+// points to. Fatal if it doesn't point to a sized type
+func pointeeSize(t *Type) int {
+	size := genprimsize(valueAt(t))
+	if size == 0 {
+		fatal("arithmetic on a pointer to an unsized type on line %d\n", Line)
+	}
+	return size
 }
 
-// Given two primitive types, return true if they are compatible,
+// Given two types, return true if they are compatible,
 // false otherwise. Also return either zero or an OpWiden
 // operation if one has to be widened to match the other.
 // If onlyRight is true, only widen left to right.
-func typeCompatible(left, right NodeType, onlyRight bool) (*OpType, *OpType, bool) {
-	// Voids not compatible with anything
-	if left == NodeVoid || right == NodeVoid {
-		return nil, nil, false
+func typeCompatible(left, right *Type, onlyRight bool) (*OpType, *OpType, bool) {
+	// Same types, they are compatible, unless they are void
+	if left.equal(right) {
+		return nil, nil, left.kind != KindVoid
 	}
-	// Same types, they are compatible
-	if left == right {
-		return nil, nil, true
+	// Otherwise only integers and pointers can be converted
+	if !left.isScalar() || !right.isScalar() {
+		return nil, nil, false
 	}
 	// Get the sizes for each type
 	leftSize := genprimsize(left)
 	rightSize := genprimsize(right)
-	// Types with zero size are not compatible with anything
-	if leftSize == 0 || rightSize == 0 {
-		return nil, nil, false
-	}
 	// Widen types as required
 	if leftSize < rightSize {
 		t := OpWiden
@@ -64,39 +316,3 @@ func typeCompatible(left, right NodeType, onlyRight bool) (*OpType, *OpType, boo
 	// Anything remaining is the same size and thus compatible
 	return nil, nil, true
 }
-
-// Given a primitive type, return
-// the type which is a pointer to it
-func pointerTo(t NodeType) NodeType {
-	switch t {
-	case NodeVoid:
-		return NodeVoidPointer
-	case NodeChar:
-		return NodeCharPointer
-	case NodeInt:
-		return NodeIntPointer
-	case NodeLong:
-		return NodeLongPointer
-	default:
-		fatal("unrecognized in pointerTo %v\n", t)
-	}
-	return 0
-}
-
-// Given a primitive pointer type, return
-// the type which it points to
-func valueAt(t NodeType) NodeType {
-	switch t {
-	case NodeVoidPointer:
-		return NodeVoid
-	case NodeCharPointer:
-		return NodeChar
-	case NodeIntPointer:
-		return NodeInt
-	case NodeLongPointer:
-		return NodeLong
-	default:
-		fatal("unrecognized in valueAt %v\n", t)
-	}
-	return 0
-}